@@ -26,8 +26,14 @@ type Alignment struct {
 	Gene1     Gene
 	Gene2     Gene
 	Score     int
+	BitScore  float64
+	Evalue    float64
 	Identical int
 	Similar   int
+	// Coverage1 and Coverage2 are percents of the sequences of Gene1 and
+	// Gene2 covered by the alignment.
+	Coverage1 float32
+	Coverage2 float32
 	Path      []Match
 }
 
@@ -43,12 +49,23 @@ type ScoreMatrix [][]int
 // according to Smith-Waterman algorithm. It takes aminoacid sequences of
 // two proteins and returns result of calculation in a structure
 func SmithWaterman(g1 Gene, g2 Gene, b62 Blosum62, conf Env) Alignment {
+	matrix := newScoreMatrix(g1.SeqLen, g2.SeqLen)
+	return smithWaterman(g1, g2, b62, conf, matrix)
+}
+
+// smithWaterman aligns two sequences using a given score matrix of
+// (g1.SeqLen+1)*(g2.SeqLen+1) cells. Only the first row and the first
+// column of the matrix have to be zero, other cells are overwritten.
+func smithWaterman(g1 Gene, g2 Gene, b62 Blosum62, conf Env,
+	matrix ScoreMatrix) Alignment {
 	var res Alignment
 	res.Gene1 = g1
 	res.Gene2 = g2
-	matrix, max := res.calculateScoreMatrix(conf, b62)
+	max := res.calculateScoreMatrix(matrix, conf, b62)
 	res.Score = max.Score
+	res.BitScore = statsFor(conf).bitScore(res.Score)
 	res.calculatePath(matrix, max)
+	res.calculateCoverage()
 	return res
 }
 
@@ -149,14 +166,20 @@ func (a *Alignment) IdentitySimilarity() (float32, float32) {
 	return identity, similarity
 }
 
-func (a *Alignment) calculateScoreMatrix(conf Env,
-	b62 Blosum62) (ScoreMatrix, MaxScore) {
-	var max MaxScore
-	var gain, score int
-	matrix := make(ScoreMatrix, a.Gene1.SeqLen+1)
+// newScoreMatrix allocates a zeroed score matrix for sequences of lengths
+// n and m.
+func newScoreMatrix(n int, m int) ScoreMatrix {
+	matrix := make(ScoreMatrix, n+1)
 	for i := range matrix {
-		matrix[i] = make([]int, a.Gene2.SeqLen+1)
+		matrix[i] = make([]int, m+1)
 	}
+	return matrix
+}
+
+func (a *Alignment) calculateScoreMatrix(matrix ScoreMatrix, conf Env,
+	b62 Blosum62) MaxScore {
+	var max MaxScore
+	var gain, score int
 
 	for j := 1; j <= a.Gene2.SeqLen; j++ {
 		for i := 1; i <= a.Gene1.SeqLen; i++ {
@@ -176,7 +199,7 @@ func (a *Alignment) calculateScoreMatrix(conf Env,
 			}
 		}
 	}
-	return matrix, max
+	return max
 }
 
 func (a *Alignment) calculatePath(matrix ScoreMatrix, max MaxScore) {
@@ -198,6 +221,16 @@ func (a *Alignment) calculatePath(matrix ScoreMatrix, max MaxScore) {
 	// a.Path = path
 }
 
+func (a *Alignment) calculateCoverage() {
+	if len(a.Path) == 0 {
+		return
+	}
+	first := a.Path[0]
+	last := a.Path[len(a.Path)-1]
+	a.Coverage1 = 100 * float32(last.I-first.I+1) / float32(a.Gene1.SeqLen)
+	a.Coverage2 = 100 * float32(last.J-first.J+1) / float32(a.Gene2.SeqLen)
+}
+
 func Reverse(path []Match) []Match {
 	last := len(path) - 1
 	for i := 0; i < len(path)/2; i++ {
@@ -1,159 +1,442 @@
 package smithwatr
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 	"log"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/lib/pq"
 )
 
-func Align(db *sql.DB, genomeTarget int, limit int, b62 Blosum62, conf Env) {
-	mChan := make(chan Alignment)
-	resChan := make(chan Alignment)
+// Align processes pending jobs of a run, aligning every claimed gene of the
+// query genome against genes of the target genome. When ctx is cancelled
+// Align stops claiming jobs, lets workers finish alignments already in
+// flight, saves them, and returns unfinished jobs to 'pending' status.
+//
+// The work goes through a pipeline: the producer sends work units, a query
+// gene with a batch of its targets, to mChan, workers send alignments to
+// resChan, and the saver stores them in batches. Query genes and targets
+// are taken longest first, so the largest pairs are aligned first. Every
+// stage closes the channel of the next stage only after it is finished, so
+// Align returns when all alignments are computed and committed.
+func Align(ctx context.Context, db *sql.DB, run Run, limit int,
+	b62 Blosum62, conf Env) error {
+	conf = run.apply(conf)
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	mChan := make(chan workUnit, conf.WorkersNum)
+	// the buffer lets workers go on while a batch is saved, when it is full
+	// workers wait for the database
+	resChan := make(chan Alignment, conf.SaveBatchSize)
+	saved := make(chan error, 1)
 	var mWG sync.WaitGroup
 
-	genesTarget := GetGenome(db, genomeTarget, limit)
+	num, err := ReclaimJobs(db, conf.JobLease)
+	if err != nil {
+		return err
+	}
+	if num > 0 {
+		log.Printf("Reclaimed %d stale jobs", num)
+	}
+	lk := newLeaseKeeper(db, run.ID, conf.JobLease)
+	defer lk.close()
+	jt := newJobTracker()
 
+	genesTarget, err := GetGenome(db, run.TargetGenomeID, limit,
+		run.LongestIsoform)
+	if err != nil {
+		return err
+	}
+	dbLen := 0
+	for _, g := range genesTarget {
+		dbLen += g.SeqLen
+	}
+	hf := newHitFilter(conf, dbLen)
+	longestFirst(genesTarget)
+
+	ms := NewMemoryScheduler(conf.MemoryBudget, conf.WorkersNum)
+	bp := &backPressure{}
 	for i := 1; i <= conf.WorkersNum; i++ {
 		mWG.Add(1)
-		go matcherWorker(db, mWG, mChan, resChan, b62, conf)
+		go matcherWorker(&mWG, mChan, resChan, b62, conf, ms, bp)
+	}
+
+	go func() {
+		err := saveResults(db, run.ID, resChan, jt, lk, hf, bp, conf)
+		if err != nil {
+			// stop the producer, and let the rest of the pipeline drain
+			cancel()
+			for range resChan {
+			}
+		}
+		saved <- err
+	}()
+
+	err = produceJobs(ctx, db, run, genesTarget, mChan, jt, lk)
+	close(mChan)
+	mWG.Wait()
+	close(resChan)
+	if saveErr := <-saved; saveErr != nil {
+		err = saveErr
 	}
 
-	go saveResults(db, resChan)
+	if ids := lk.claimed(); len(ids) > 0 {
+		log.Printf("Returning %d unfinished jobs to pending", len(ids))
+		if relErr := releaseJobs(db, run.ID, ids); err == nil {
+			err = relErr
+		}
+	}
+	return err
+}
 
+// produceJobs claims jobs of a run one by one and sends work units of
+// pairs of genes for alignment to mChan until there are no more jobs, or
+// ctx is cancelled.
+func produceJobs(ctx context.Context, db *sql.DB, run Run,
+	genesTarget []Gene, mChan chan<- workUnit, jt *jobTracker,
+	lk *leaseKeeper) error {
 	count := 0
 	for {
+		if ctx.Err() != nil {
+			log.Println("Alignment is interrupted, finishing started work")
+			return nil
+		}
 		count += 1
-		gene := getAJob(db)
-		if gene.ID > 0 {
-			log.Printf("Alignment %d for %s, size %d", count, gene.Gene, gene.SeqLen)
-			for _, g := range genesTarget {
-				mChan <- Alignment{Gene1: gene, Gene2: g}
+		gene, err := getAJob(db, run.ID)
+		if err != nil || gene.ID == 0 {
+			return err
+		}
+		lk.add(gene.ID)
+		log.Printf("Alignment %d for %s, size %d", count, gene.Gene, gene.SeqLen)
+		targets := pairTargets(gene, genesTarget)
+		if len(targets) == 0 {
+			if err = markFinished(db, run.ID, []int{gene.ID}); err != nil {
+				return err
 			}
-			err := db.QueryRow(`UPDATE jobs
-			                      SET status = 'finished'
-														WHERE gene_id = $1`, gene.ID).Scan()
-			if err != sql.ErrNoRows {
-				Check(err)
+			lk.remove(gene.ID)
+			continue
+		}
+		jt.add(gene.ID, len(targets))
+		for _, u := range workUnits(gene, targets) {
+			select {
+			case mChan <- u:
+			case <-ctx.Done():
+				log.Println("Alignment is interrupted, finishing started work")
+				return nil
 			}
-		} else {
-			close(mChan)
-			break
 		}
 	}
-	mWG.Wait()
-	close(resChan)
 }
 
-func getAJob(db *sql.DB) Gene {
+// pairTargets returns genes a query gene has to be aligned with. When a
+// genome is compared with itself, self pairs are skipped, and only targets
+// with larger IDs are aligned, because the other triangle of the
+// comparison matrix gives the same results.
+func pairTargets(gene Gene, targets []Gene) []Gene {
+	if len(targets) == 0 || targets[0].GenomeID != gene.GenomeID {
+		return targets
+	}
+	res := make([]Gene, 0, len(targets))
+	for _, g := range targets {
+		if g.ID > gene.ID {
+			res = append(res, g)
+		}
+	}
+	return res
+}
+
+// getAJob claims a pending job of a run, the one with the longest query
+// sequence, and returns its gene. An empty gene means no jobs are left.
+// Jobs keep lengths of their sequences, so the index of jobs gives the
+// longest one without sorting the queue.
+func getAJob(db *sql.DB, runID int) (Gene, error) {
 	var id, genomeID int
 	var gene, sequence string
 
 	q1 := `UPDATE jobs
-	         SET status = 'started'
-					 WHERE gene_id = (SELECT gene_id
-															FROM jobs
-															WHERE status = 'pending'
-															LIMIT 1)
-				RETURNING gene_id`
+	         SET status = 'started', started_at = now(), heartbeat_at = now()
+	         WHERE run_id = $1
+	           AND gene_id = (SELECT gene_id
+	                            FROM jobs
+	                            WHERE run_id = $1 AND status = 'pending'
+	                            ORDER BY seq_len DESC, gene_id
+	                            LIMIT 1
+	                            FOR UPDATE SKIP LOCKED)
+	       RETURNING gene_id`
 
 	q2 := `SELECT genome_id, gene, sequence
 	        FROM genes
 					WHERE id = $1`
 
-	err := db.QueryRow(q1).Scan(&id)
-	Check(err)
+	err := db.QueryRow(q1, runID).Scan(&id)
+	if err == sql.ErrNoRows {
+		return Gene{}, nil
+	}
+	if err != nil {
+		return Gene{}, dbError("claim a job", err)
+	}
 
 	err = db.QueryRow(q2, id).Scan(&genomeID, &gene, &sequence)
-	Check(err)
+	if err != nil {
+		return Gene{}, dbError("read a gene of a job", err)
+	}
 
 	seqRunes := []rune(sequence)
 
 	return Gene{ID: id, GenomeID: genomeID, Gene: gene, Seq: seqRunes,
-		SeqLen: len(seqRunes)}
+		SeqLen: len(seqRunes)}, nil
+}
+
+// backPressure measures how long workers wait for the saver when the
+// buffer of results is full, that is how much the database slows down
+// alignment.
+type backPressure struct {
+	// waited is the time in nanoseconds since the last report
+	waited int64
+}
+
+// send sends an alignment to resChan, and counts the time it waits if the
+// channel is full.
+func (bp *backPressure) send(resChan chan<- Alignment, a Alignment) {
+	select {
+	case resChan <- a:
+		return
+	default:
+	}
+	start := time.Now()
+	resChan <- a
+	atomic.AddInt64(&bp.waited, int64(time.Since(start)))
 }
 
-func saveResults(db *sql.DB, resChan <-chan Alignment) {
-	res := make([]Alignment, 1000)
-	i := 0
-	k := 1
-	for gm := range resChan {
-		res[i] = gm
-		i++
-		if i%1000 == 0 {
-			bulkSave(db, res)
-			// log.Printf("%d: saved", i*k)
-			i = 0
-			k++
-		}
-	}
-	bulkSave(db, res[0:i-1])
+// report logs how long workers waited for the database since the last
+// report, if they did.
+func (bp *backPressure) report() {
+	if w := time.Duration(atomic.SwapInt64(&bp.waited, 0)); w > 0 {
+		log.Printf("Saving is slower than alignment, workers waited %s "+
+			"for the database", w.Round(time.Millisecond))
+	}
 }
 
-func bulkSave(db *sql.DB, gms []Alignment) {
+// saveResults collects alignments that pass the hit filter into batches and
+// saves them until resChan is closed, including the last incomplete batch.
+// A batch is saved when it has conf.SaveBatchSize alignments, or when
+// conf.SaveInterval passed since the last save, so slow runs still persist
+// progress. Jobs which got all their alignments saved are marked as
+// finished in the same transaction. Workers block while resChan is full,
+// the time they wait is reported after every save.
+func saveResults(db *sql.DB, runID int, resChan <-chan Alignment,
+	jt *jobTracker, lk *leaseKeeper, hf *hitFilter, bp *backPressure,
+	conf Env) error {
+	batchSize := conf.SaveBatchSize
+	if batchSize < 1 {
+		batchSize = defaultSaveBatchSize
+	}
+	interval := conf.SaveInterval
+	if interval <= 0 {
+		interval = defaultSaveInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	batch := make([]Alignment, 0, batchSize)
+	var finished []int
+	save := func() error {
+		if len(batch) == 0 && len(finished) == 0 {
+			return nil
+		}
+		err := saveWithRetry(db, runID, batch, finished, conf.SaveRetries)
+		if err != nil {
+			return err
+		}
+		bp.report()
+		for _, id := range finished {
+			lk.remove(id)
+		}
+		batch = batch[:0]
+		finished = finished[:0]
+		return nil
+	}
+	for {
+		select {
+		case gm, ok := <-resChan:
+			if !ok {
+				return save()
+			}
+			batch = append(batch, hf.add(gm)...)
+			if id := gm.Gene1.ID; jt.received(id) {
+				batch = append(batch, hf.flush(id)...)
+				finished = append(finished, id)
+			}
+			if len(batch) < batchSize {
+				continue
+			}
+		case <-ticker.C:
+		}
+		if err := save(); err != nil {
+			return err
+		}
+	}
+}
+
+// saveWithRetry calls bulkSave, repeating it after transient database
+// errors up to retries times with growing pauses between attempts.
+func saveWithRetry(db *sql.DB, runID int, batch []Alignment,
+	finished []int, retries int) error {
+	pause := time.Second
+	for i := 0; ; i++ {
+		err := bulkSave(db, runID, batch, finished)
+		if err == nil || i >= retries || !isTransient(err) {
+			return err
+		}
+		log.Printf("Saving alignments failed, retry in %s: %s", pause, err)
+		time.Sleep(pause)
+		pause *= 2
+	}
+}
+
+// bulkSave copies a batch of alignments into a temporary table and moves
+// them to genes_matches from there. Rows that already exist are
+// overwritten, so saving the same results twice after a restart is safe.
+// Jobs with finished IDs are marked as finished in the same transaction.
+func bulkSave(db *sql.DB, runID int, gms []Alignment,
+	finished []int) (err error) {
 	batch := gms
-	columns := []string{"gene_id", "match_gene_id", "score", "identical_num",
-		"similar_num", "ident_percent", "sim_percent"}
+	columns := []string{"run_id", "gene_id", "match_gene_id", "score",
+		"identical_num", "similar_num", "ident_percent", "sim_percent",
+		"bit_score", "evalue", "query_coverage", "target_coverage"}
 	transaction, err := db.Begin()
-	Check(err)
+	if err != nil {
+		return dbError("start a transaction", err)
+	}
+	defer func() {
+		if err != nil {
+			transaction.Rollback()
+		}
+	}()
+
+	_, err = transaction.Exec(`CREATE TEMP TABLE genes_matches_tmp
+	                             (LIKE genes_matches) ON COMMIT DROP`)
+	if err != nil {
+		return dbError("create a temporary table", err)
+	}
 
-	stmt, err := transaction.Prepare(pq.CopyIn("genes_matches", columns...))
-	Check(err)
+	stmt, err := transaction.Prepare(pq.CopyIn("genes_matches_tmp",
+		columns...))
+	if err != nil {
+		return dbError("prepare alignments copy", err)
+	}
 
 	for _, gm := range batch {
 		ident, sim := gm.IdentitySimilarity()
-		_, err = stmt.Exec(gm.Gene1.ID, gm.Gene2.ID, gm.Score, gm.Identical,
-			gm.Similar, ident, sim)
-		Check(err)
+		_, err = stmt.Exec(runID, gm.Gene1.ID, gm.Gene2.ID, gm.Score,
+			gm.Identical, gm.Similar, ident, sim, gm.BitScore, gm.Evalue,
+			gm.Coverage1, gm.Coverage2)
+		if err != nil {
+			return dbError("copy alignments", err)
+		}
 	}
 
 	_, err = stmt.Exec()
 	if err != nil {
-		log.Println(`
-Bulk import of titles data failed, probably you need to empty all data
-and start with an empty database.
-`)
-		log.Fatal(err)
+		return dbError("copy alignments", err)
 	}
 
 	err = stmt.Close()
-	Check(err)
+	if err != nil {
+		return dbError("copy alignments", err)
+	}
+
+	_, err = transaction.Exec(`INSERT INTO genes_matches
+	                             SELECT * FROM genes_matches_tmp
+	                           ON CONFLICT (run_id, gene_id, match_gene_id)
+	                           DO UPDATE
+	                             SET score = EXCLUDED.score,
+	                                 identical_num = EXCLUDED.identical_num,
+	                                 similar_num = EXCLUDED.similar_num,
+	                                 ident_percent = EXCLUDED.ident_percent,
+	                                 sim_percent = EXCLUDED.sim_percent,
+	                                 bit_score = EXCLUDED.bit_score,
+	                                 evalue = EXCLUDED.evalue,
+	                                 query_coverage = EXCLUDED.query_coverage,
+	                                 target_coverage = EXCLUDED.target_coverage`)
+	if err != nil {
+		return dbError("save alignments", err)
+	}
+
+	if len(finished) > 0 {
+		_, err = transaction.Exec(`UPDATE jobs
+		                             SET status = 'finished'
+		                             WHERE run_id = $1 AND gene_id = ANY($2)`,
+			runID, pq.Array(finished))
+		if err != nil {
+			return dbError("mark jobs as finished", err)
+		}
+	}
 
 	err = transaction.Commit()
-	Check(err)
+	return dbError("commit alignments", err)
 }
 
-func matcherWorker(db *sql.DB, mWG sync.WaitGroup, mChan <-chan Alignment,
-	resChan chan<- Alignment, b62 Blosum62, conf Env) {
+// matcherWorker aligns pairs of genes until mChan is closed. Pairs that
+// are already taken are always finished and sent to resChan, so stopping
+// the producer is enough to drain the pipeline.
+func matcherWorker(mWG *sync.WaitGroup, mChan <-chan workUnit,
+	resChan chan<- Alignment, b62 Blosum62, conf Env, ms *MemoryScheduler,
+	bp *backPressure) {
 	defer mWG.Done()
-	for g := range mChan {
-		resChan <- SmithWaterman(g.Gene1, g.Gene2, b62, conf)
+	m := ms.matcher()
+	defer m.release(ms)
+	for u := range mChan {
+		for _, t := range u.targets {
+			bp.send(resChan, m.alignWithin(ms, u.gene, t, b62, conf))
+		}
 	}
 }
 
-func GetGenome(db *sql.DB, genome int, num int) []Gene {
+// GetGenome returns genes of a genome. If num is positive, only first num
+// genes are returned. If longest is true, only the longest isoform of every
+// locus is returned.
+func GetGenome(db *sql.DB, genome int, num int,
+	longest bool) ([]Gene, error) {
 	var ID, genomeID int
 	var gene, sequence string
 	var res []Gene
 	q := `SELECT id, genome_id, gene, sequence
-	       FROM genes where genome_id = $1`
+	       FROM genes where genome_id = $1 AND (longest OR NOT $2)
+	       ORDER BY id`
 	if num > 0 {
 		q = fmt.Sprintf("%s LIMIT %d", q, num)
 	}
 
-	rows, err := db.Query(q, genome)
-	Check(err)
+	rows, err := db.Query(q, genome, longest)
+	if err != nil {
+		return nil, dbError("read genes of a genome", err)
+	}
+	defer rows.Close()
 	for rows.Next() {
 		err := rows.Scan(&ID, &genomeID, &gene, &sequence)
-		Check(err)
+		if err != nil {
+			return nil, dbError("read genes of a genome", err)
+		}
 		seqRunes := []rune(sequence)
 		gene := Gene{ID: ID, GenomeID: genomeID, Gene: gene, Seq: seqRunes,
 			SeqLen: len(seqRunes)}
 		res = append(res, gene)
 	}
-	err = rows.Close()
-	Check(err)
-	return res
+	return res, dbError("read genes of a genome", rows.Err())
+}
+
+// genomeLength returns the total number of residues in a genome, or in
+// the longest isoforms of its genes.
+func genomeLength(db *sql.DB, genome int, longest bool) (int, error) {
+	var res int
+	q := `SELECT coalesce(sum(length(sequence)), 0)
+	        FROM genes
+	        WHERE genome_id = $1 AND (longest OR NOT $2)`
+	err := db.QueryRow(q, genome, longest).Scan(&res)
+	return res, dbError("calculate genome length", err)
 }
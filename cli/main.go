@@ -1,10 +1,16 @@
 package main
 
 import (
+	"context"
+	"database/sql"
+	"flag"
 	"fmt"
 	"log"
+	"net/http"
 	"os"
+	"os/signal"
 	"strconv"
+	"syscall"
 
 	. "github.com/dimus/smithwatr"
 )
@@ -12,36 +18,617 @@ import (
 var githash = "n/a"
 var buildstamp = "n/a"
 
+// conf is the effective configuration, settings show where its values
+// came from.
+var conf Env
+var settings []Setting
+
 func main() {
 	var command string
-	if len(os.Args) > 1 {
-		command = os.Args[1]
+	var args []string
+	var err error
+	conf, settings, args, err = LoadConfig(os.Args[1:])
+	if err == flag.ErrHelp {
+		return
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(args) > 0 {
+		command = args[0]
 	}
 	switch command {
 	case "version":
 		fmt.Printf(" Git commit hash: %s\n UTC Build Time: %s\n\n",
 			githash, buildstamp)
 	case "align":
-		if len(os.Args) > 3 {
-			var genome1, genome2 int
-			log.Println("Importing data")
-			b62 := InitBlosum62()
-			conf := EnvVars()
-			db, err := Connect(conf)
-			Check(err)
-			genome1, err = strconv.Atoi(os.Args[2])
-			Check(err)
-			genome2, err = strconv.Atoi(os.Args[3])
-			Check(err)
-			ImportData(db, conf)
-			log.Println("Importing jobs")
-			ImportJobs(db, genome1)
-			log.Println("Aligning genomes")
-			Align(db, genome2, -1, b62, conf)
+		if len(args) > 2 {
+			err = align(args[1], args[2])
 		} else {
 			fmt.Printf("Not enough arguments. Example:\n\n%s align 1 2", os.Args[0])
 		}
+	case "align-all":
+		ordered := !(len(args) > 1 && args[1] == "unordered")
+		err = alignAll(ordered)
+	case "config":
+		if len(args) > 1 && args[1] == "show" {
+			configShow()
+		} else {
+			fmt.Printf("Not enough arguments. Example:\n\n%s config show",
+				os.Args[0])
+		}
+	case "coordinator":
+		if len(args) > 2 {
+			err = coordinator(args[1], args[2:])
+		} else {
+			fmt.Printf("Not enough arguments. Example:\n\n%s coordinator :8080 1 2",
+				os.Args[0])
+		}
+	case "worker":
+		if len(args) > 1 {
+			err = worker(args[1])
+		} else {
+			fmt.Printf("Not enough arguments. Example:\n\n%s worker "+
+				"http://localhost:8080", os.Args[0])
+		}
+	case "cluster":
+		if len(args) > 3 {
+			err = cluster(args[1], args[2], args[3:])
+		} else {
+			fmt.Printf("Not enough arguments. Example:\n\n%s cluster mcl "+
+				"groups.txt 1 2", os.Args[0])
+		}
+	case "db":
+		if len(args) > 2 && args[1] == "migrate" {
+			var steps string
+			if len(args) > 3 {
+				steps = args[3]
+			}
+			err = dbMigrate(args[2], steps)
+		} else {
+			fmt.Printf("Not enough arguments. Example:\n\n"+
+				"%[1]s db migrate up\n%[1]s db migrate down [1|all]\n"+
+				"%[1]s db migrate status", os.Args[0])
+		}
+	case "genome":
+		var sub string
+		if len(args) > 1 {
+			sub = args[1]
+		}
+		switch {
+		case sub == "add" && len(args) > 4:
+			var taxon string
+			if len(args) > 5 {
+				taxon = args[5]
+			}
+			err = genomeAdd(args[2], args[3], args[4], taxon)
+		case sub == "import" && len(args) > 2:
+			var file string
+			if len(args) > 3 {
+				file = args[3]
+			}
+			err = genomeImport(args[2], file)
+		case sub == "history" && len(args) > 2:
+			err = genomeHistory(args[2])
+		case sub == "list":
+			err = genomeList()
+		case sub == "remove" && len(args) > 2:
+			err = genomeRemove(args[2])
+		default:
+			fmt.Printf("Not enough arguments. Example:\n\n"+
+				"%[1]s genome add Mus_musculus.GRCm38.pep.all.fa.gz "+
+				"'Mus musculus' Mouse [10090]\n%[1]s genome import 4 "+
+				"[new_version.fa.gz]\n%[1]s genome history 4\n"+
+				"%[1]s genome list\n%[1]s genome remove 4", os.Args[0])
+		}
+	case "paralogs":
+		if len(args) > 2 {
+			var out string
+			if len(args) > 3 {
+				out = args[3]
+			}
+			err = paralogs(args[1], args[2], out)
+		} else {
+			fmt.Printf("Not enough arguments. Example:\n\n%s paralogs 1 2 "+
+				"[inparalogs.txt]", os.Args[0])
+		}
+	case "rbh":
+		if len(args) > 2 {
+			var tsv string
+			if len(args) > 3 {
+				tsv = args[3]
+			}
+			err = rbh(args[1], args[2], tsv)
+		} else {
+			fmt.Printf("Not enough arguments. Example:\n\n%s rbh 1 2 [orthologs.tsv]",
+				os.Args[0])
+		}
+	case "resume":
+		if len(args) > 1 {
+			err = resume(args[1])
+		} else {
+			fmt.Printf("Not enough arguments. Example:\n\n%s resume 1", os.Args[0])
+		}
+	case "runs":
+		err = runs()
+	default:
+		fmt.Printf("Usage:\n\n%[1]s align 3 2\n%[1]s align-all [unordered]\n"+
+			"%[1]s cluster mcl|single groups.txt 1 2\n%[1]s config show\n"+
+			"%[1]s coordinator :8080 1 2\n%[1]s worker http://localhost:8080\n"+
+			"%[1]s db migrate up|down [1|all]|status\n"+
+			"%[1]s genome add file.fa.gz 'Mus musculus' Mouse [10090]\n"+
+			"%[1]s genome import 4 [new_version.fa.gz]\n"+
+			"%[1]s genome history 4\n%[1]s genome list\n"+
+			"%[1]s genome remove 4\n"+
+			"%[1]s paralogs 1 2 [inparalogs.txt]\n"+
+			"%[1]s rbh 1 2 [orthologs.tsv]\n%[1]s resume 1\n%[1]s runs\n\n",
+			os.Args[0])
+		fmt.Printf("Settings can be given in a YAML or TOML file with "+
+			"-config, in environment\nvariables, or as flags before the "+
+			"command, like -top-n 5. See '%s -h'.\n", os.Args[0])
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// setup reads configuration, connects to the database and checks that
+// its schema is up to date.
+func setup() (Env, *sql.DB, error) {
+	db, err := Connect(conf)
+	if err != nil {
+		return conf, nil, err
+	}
+	return conf, db, CheckSchema(db)
+}
+
+// dbMigrate applies or reverts schema migrations, or shows the schema
+// version.
+func dbMigrate(action string, steps string) error {
+	db, err := Connect(conf)
+	if err != nil {
+		return err
+	}
+	var ms []Migration
+	switch action {
+	case "up":
+		ms, err = MigrateUp(db)
+	case "down":
+		n := 1
+		if steps == "all" {
+			n = 0
+		} else if steps != "" {
+			if n, err = strconv.Atoi(steps); err != nil {
+				return err
+			}
+		}
+		ms, err = MigrateDown(db, n)
+	case "status":
+		return dbStatus(db)
 	default:
-		fmt.Printf("Usage:\n\n%s align 3 2\n\n", os.Args[0])
+		return fmt.Errorf("Unknown migration action %q", action)
+	}
+	for _, m := range ms {
+		log.Printf("Migrated %s: %d_%s", action, m.Version, m.Name)
+	}
+	return err
+}
+
+// configShow prints the effective configuration and the source of every
+// value.
+func configShow() {
+	fmt.Printf("%-22s %-24s %-8s %s\n", "key", "value", "source", "env")
+	for _, s := range settings {
+		fmt.Printf("%-22s %-24s %-8s %s\n", s.Key, s.Value, s.Source, s.Env)
+	}
+}
+
+func dbStatus(db *sql.DB) error {
+	ms, err := Migrations()
+	if err != nil {
+		return err
+	}
+	version, dirty, err := SchemaVersion(db)
+	if err != nil {
+		return err
+	}
+	for _, m := range ms {
+		status := "pending"
+		if m.Version <= version {
+			status = "applied"
+		}
+		if m.Version == version && dirty {
+			status = "dirty"
+		}
+		fmt.Printf("%-8s %d_%s\n", status, m.Version, m.Name)
+	}
+	return nil
+}
+
+func align(query string, target string) error {
+	genome1, err := strconv.Atoi(query)
+	if err != nil {
+		return err
+	}
+	genome2, err := strconv.Atoi(target)
+	if err != nil {
+		return err
+	}
+	conf, db, err := setup()
+	if err != nil {
+		return err
+	}
+	log.Println("Importing data")
+	if err = ImportData(db, conf); err != nil {
+		return err
+	}
+	run, err := FindOrCreateRun(db, genome1, genome2, conf)
+	if err != nil {
+		return err
+	}
+	log.Printf("Importing jobs for run %d", run.ID)
+	if err = ImportJobs(db, run); err != nil {
+		return err
+	}
+	log.Println("Aligning genomes")
+	return Align(interruptContext(), db, run, -1, InitBlosum62(), conf)
+}
+
+func alignAll(ordered bool) error {
+	conf, db, err := setup()
+	if err != nil {
+		return err
+	}
+	log.Println("Importing data")
+	if err = ImportData(db, conf); err != nil {
+		return err
+	}
+	runs, err := PlanRuns(db, conf, ordered)
+	if err != nil {
+		return err
+	}
+	log.Printf("Planned %d runs", len(runs))
+	return AlignAll(interruptContext(), db, runs, InitBlosum62(), conf)
+}
+
+func coordinator(addr string, runIDs []string) error {
+	conf, db, err := setup()
+	if err != nil {
+		return err
+	}
+	var runs []Run
+	for _, arg := range runIDs {
+		runID, err := strconv.Atoi(arg)
+		if err != nil {
+			return err
+		}
+		run, err := GetRun(db, runID)
+		if err != nil {
+			return err
+		}
+		if err = ImportJobs(db, run); err != nil {
+			return err
+		}
+		runs = append(runs, run)
+	}
+	log.Printf("Coordinating %d runs on %s", len(runs), addr)
+	srv := &http.Server{Addr: addr, Handler: NewCoordinator(db, runs, -1, conf)}
+	ctx := interruptContext()
+	go func() {
+		<-ctx.Done()
+		if err := srv.Shutdown(context.Background()); err != nil {
+			log.Println(err)
+		}
+	}()
+	err = srv.ListenAndServe()
+	if err == http.ErrServerClosed {
+		return nil
+	}
+	return err
+}
+
+func worker(url string) error {
+	log.Printf("Working for %s", url)
+	return RunWorker(interruptContext(), url, InitBlosum62(), conf)
+}
+
+func resume(runIDStr string) error {
+	runID, err := strconv.Atoi(runIDStr)
+	if err != nil {
+		return err
+	}
+	conf, db, err := setup()
+	if err != nil {
+		return err
+	}
+	run, err := GetRun(db, runID)
+	if err != nil {
+		return err
+	}
+	log.Printf("Resuming run %d", run.ID)
+	return Align(interruptContext(), db, run, -1, InitBlosum62(), conf)
+}
+
+// genomeAdd registers a genome file and imports its genes.
+func genomeAdd(file string, species string, short string,
+	taxon string) error {
+	g := Genome{FileName: file, Species: species, SpeciesShort: short}
+	if taxon != "" {
+		var err error
+		if g.TaxonID, err = strconv.Atoi(taxon); err != nil {
+			return err
+		}
+	}
+	conf, db, err := setup()
+	if err != nil {
+		return err
+	}
+	if g, err = AddGenome(db, g); err != nil {
+		return err
+	}
+	log.Printf("Genome %d is registered", g.ID)
+	return importGenome(db, conf, g)
+}
+
+// genomeImport imports a new version of a genome, optionally from a new
+// file.
+func genomeImport(genome string, file string) error {
+	id, err := strconv.Atoi(genome)
+	if err != nil {
+		return err
+	}
+	conf, db, err := setup()
+	if err != nil {
+		return err
+	}
+	if file != "" {
+		if err = SetGenomeFile(db, id, file); err != nil {
+			return err
+		}
+	}
+	g, err := GetGenomeInfo(db, id)
+	if err != nil {
+		return err
+	}
+	return importGenome(db, conf, g)
+}
+
+func importGenome(db *sql.DB, conf Env, g Genome) error {
+	rep, err := ImportGenome(db, conf, g)
+	if err != nil {
+		return err
+	}
+	if rep.Skipped {
+		log.Printf("Genome %d: %s is imported already", g.ID, rep.FileName)
+		return nil
+	}
+	log.Printf("Genome %d: %d genes added, %d removed, %d changed, "+
+		"%d unchanged", g.ID, rep.Added, rep.Removed, rep.Changed,
+		rep.Unchanged)
+	return nil
+}
+
+func genomeHistory(genome string) error {
+	id, err := strconv.Atoi(genome)
+	if err != nil {
+		return err
+	}
+	_, db, err := setup()
+	if err != nil {
+		return err
+	}
+	reps, err := ImportHistory(db, id)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%-19s %7s %7s %7s %9s %-16s %s\n", "imported", "added",
+		"removed", "changed", "unchanged", "sha256", "file")
+	for _, r := range reps {
+		fmt.Printf("%-19s %7d %7d %7d %9d %-16s %s\n",
+			r.ImportedAt.Format("2006-01-02 15:04:05"), r.Added, r.Removed,
+			r.Changed, r.Unchanged, r.Checksum[:16], r.FileName)
+	}
+	return nil
+}
+
+func genomeList() error {
+	_, db, err := setup()
+	if err != nil {
+		return err
+	}
+	gs, err := ListGenomes(db)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%6s %8s %8s %-20s %s\n", "genome", "taxon", "genes",
+		"short", "file")
+	for _, g := range gs {
+		fmt.Printf("%6d %8d %8d %-20s %s\n", g.ID, g.TaxonID, g.GenesNum,
+			g.SpeciesShort, g.FileName)
+	}
+	return nil
+}
+
+func genomeRemove(genome string) error {
+	id, err := strconv.Atoi(genome)
+	if err != nil {
+		return err
+	}
+	_, db, err := setup()
+	if err != nil {
+		return err
+	}
+	return RemoveGenome(db, id)
+}
+
+func paralogs(genome string, reference string, out string) error {
+	genome1, err := strconv.Atoi(genome)
+	if err != nil {
+		return err
+	}
+	genome2, err := strconv.Atoi(reference)
+	if err != nil {
+		return err
+	}
+	conf, db, err := setup()
+	if err != nil {
+		return err
+	}
+	selfRun, err := FindRun(db, genome1, genome1, conf)
+	if err != nil {
+		return err
+	}
+	refRun, err := FindRun(db, genome1, genome2, conf)
+	if err != nil {
+		return err
 	}
+	groups, err := InParalogs(db, selfRun, refRun)
+	if err != nil {
+		return err
+	}
+	log.Printf("Found %d in-paralog groups", len(groups))
+	var ids []int
+	for _, g := range groups {
+		ids = append(ids, g...)
+	}
+	labels, err := GeneLabels(db, ids)
+	if err != nil {
+		return err
+	}
+	if out == "" {
+		return WriteGroups(os.Stdout, groups, labels, "INPARA")
+	}
+	f, err := os.Create(out)
+	if err != nil {
+		return err
+	}
+	if err = WriteGroups(f, groups, labels, "INPARA"); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func rbh(genomeA string, genomeB string, tsv string) error {
+	genome1, err := strconv.Atoi(genomeA)
+	if err != nil {
+		return err
+	}
+	genome2, err := strconv.Atoi(genomeB)
+	if err != nil {
+		return err
+	}
+	conf, db, err := setup()
+	if err != nil {
+		return err
+	}
+	runAB, err := FindRun(db, genome1, genome2, conf)
+	if err != nil {
+		return err
+	}
+	runBA, err := FindRun(db, genome2, genome1, conf)
+	if err != nil {
+		return err
+	}
+	orthologs, err := ReciprocalBestHits(db, runAB, runBA, conf.RBH)
+	if err != nil {
+		return err
+	}
+	log.Printf("Found %d reciprocal best hits", len(orthologs))
+	if err = SaveOrthologs(db, runAB, runBA, orthologs); err != nil {
+		return err
+	}
+	if tsv == "" {
+		return nil
+	}
+	f, err := os.Create(tsv)
+	if err != nil {
+		return err
+	}
+	if err = WriteOrthologsTSV(f, orthologs); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func cluster(method string, groups string, runArgs []string) error {
+	var runIDs []int
+	for _, arg := range runArgs {
+		runID, err := strconv.Atoi(arg)
+		if err != nil {
+			return err
+		}
+		runIDs = append(runIDs, runID)
+	}
+	conf, db, err := setup()
+	if err != nil {
+		return err
+	}
+	opts := conf.Cluster
+	opts.Method = method
+	g, err := LoadGraph(db, runIDs, opts)
+	if err != nil {
+		return err
+	}
+	clusters, err := g.Cluster(opts)
+	if err != nil {
+		return err
+	}
+	id, err := SaveClusters(db, clusters, runIDs, opts)
+	if err != nil {
+		return err
+	}
+	log.Printf("Clustering %d has %d clusters", id, len(clusters))
+	labels, err := GeneLabels(db, g.Nodes())
+	if err != nil {
+		return err
+	}
+	f, err := os.Create(groups)
+	if err != nil {
+		return err
+	}
+	if err = WriteGroups(f, clusters, labels, "SW"); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func runs() error {
+	_, db, err := setup()
+	if err != nil {
+		return err
+	}
+	rps, err := ListRuns(db)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%5s %6s %6s %4s %4s %4s %7s %9s %9s %9s\n", "run", "query",
+		"target", "gopn", "gext", "top", "longest", "pending", "started",
+		"finished")
+	for _, r := range rps {
+		fmt.Printf("%5d %6d %6d %4d %4d %4d %7t %9d %9d %9d\n", r.ID,
+			r.QueryGenomeID, r.TargetGenomeID, r.GapOpens, r.GapExtends, r.TopN,
+			r.LongestIsoform, r.Pending, r.Started, r.Finished)
+	}
+	return nil
+}
+
+// interruptContext returns a context that is cancelled on SIGINT or
+// SIGTERM, so running commands can finish their work and exit cleanly.
+// A second signal terminates the program immediately.
+func interruptContext() context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+	sigs := make(chan os.Signal, 2)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-sigs
+		log.Printf("Got %s signal, shutting down", sig)
+		cancel()
+		<-sigs
+		log.Println("Exiting immediately")
+		os.Exit(1)
+	}()
+	return ctx
 }
@@ -0,0 +1,360 @@
+package smithwatr
+
+import (
+	"database/sql"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// Clustering methods.
+const (
+	// MethodMCL is Markov clustering.
+	MethodMCL = "mcl"
+	// MethodSingleLinkage puts connected genes into the same cluster.
+	MethodSingleLinkage = "single"
+)
+
+// Weights of similarity graph edges.
+const (
+	WeightBitScore = "bitscore"
+	WeightIdentity = "identity"
+)
+
+// ClusterOptions configures protein family clustering.
+type ClusterOptions struct {
+	Method string
+	// Weight is a property of an alignment used as an edge weight.
+	Weight string
+	// MinWeight drops edges with a smaller weight.
+	MinWeight float64
+	// Inflation is the MCL inflation parameter, larger values give smaller
+	// clusters.
+	Inflation float64
+}
+
+// Graph is an undirected weighted graph of similarity between genes.
+type Graph struct {
+	edges map[int]map[int]float64
+}
+
+// NewGraph creates an empty similarity graph.
+func NewGraph() *Graph {
+	return &Graph{edges: make(map[int]map[int]float64)}
+}
+
+// AddEdge connects two genes. If they are already connected, the larger
+// weight is kept. Self hits only add the gene to the graph.
+func (g *Graph) AddEdge(gene1 int, gene2 int, weight float64) {
+	g.addNode(gene1)
+	g.addNode(gene2)
+	if gene1 == gene2 {
+		return
+	}
+	if w, ok := g.edges[gene1][gene2]; !ok || w < weight {
+		g.edges[gene1][gene2] = weight
+		g.edges[gene2][gene1] = weight
+	}
+}
+
+func (g *Graph) addNode(id int) {
+	if _, ok := g.edges[id]; !ok {
+		g.edges[id] = make(map[int]float64)
+	}
+}
+
+// Nodes returns sorted IDs of all genes of the graph.
+func (g *Graph) Nodes() []int {
+	res := make([]int, 0, len(g.edges))
+	for id := range g.edges {
+		res = append(res, id)
+	}
+	sort.Ints(res)
+	return res
+}
+
+// AddAlignments adds edges for alignments which weight is not smaller than
+// opts.MinWeight.
+func (g *Graph) AddAlignments(as []Alignment, opts ClusterOptions) {
+	for _, a := range as {
+		w := a.BitScore
+		if opts.Weight == WeightIdentity {
+			ident, _ := a.IdentitySimilarity()
+			w = float64(ident)
+		}
+		if w >= opts.MinWeight {
+			g.AddEdge(a.Gene1.ID, a.Gene2.ID, w)
+		}
+	}
+}
+
+// LoadGraph creates a similarity graph from genes_matches of given runs.
+func LoadGraph(db *sql.DB, runIDs []int, opts ClusterOptions) (*Graph,
+	error) {
+	col := "bit_score"
+	if opts.Weight == WeightIdentity {
+		col = "ident_percent"
+	}
+	q := fmt.Sprintf(`SELECT gene_id, match_gene_id, %s
+	                    FROM genes_matches
+	                    WHERE run_id = ANY($1) AND %s >= $2`, col, col)
+	rows, err := db.Query(q, pq.Array(runIDs), opts.MinWeight)
+	if err != nil {
+		return nil, dbError("load similarity graph", err)
+	}
+	defer rows.Close()
+	g := NewGraph()
+	for rows.Next() {
+		var gene1, gene2 int
+		var w float64
+		if err := rows.Scan(&gene1, &gene2, &w); err != nil {
+			return nil, dbError("load similarity graph", err)
+		}
+		g.AddEdge(gene1, gene2, w)
+	}
+	return g, dbError("load similarity graph", rows.Err())
+}
+
+// Cluster splits the graph into gene families with the method of opts.
+// Clusters are sorted by size, largest first.
+func (g *Graph) Cluster(opts ClusterOptions) ([][]int, error) {
+	switch opts.Method {
+	case MethodMCL:
+		return g.MCL(opts.Inflation), nil
+	case MethodSingleLinkage:
+		return g.SingleLinkage(), nil
+	default:
+		return nil, fmt.Errorf("Unknown clustering method %q", opts.Method)
+	}
+}
+
+// SingleLinkage returns connected components of the graph.
+func (g *Graph) SingleLinkage() [][]int {
+	parent := make(map[int]int)
+	var find func(int) int
+	find = func(id int) int {
+		if p := parent[id]; p != id {
+			parent[id] = find(p)
+		}
+		return parent[id]
+	}
+	for id := range g.edges {
+		parent[id] = id
+	}
+	for id, nbs := range g.edges {
+		for nb := range nbs {
+			if r1, r2 := find(id), find(nb); r1 != r2 {
+				parent[r1] = r2
+			}
+		}
+	}
+	groups := make(map[int][]int)
+	for id := range g.edges {
+		root := find(id)
+		groups[root] = append(groups[root], id)
+	}
+	return sortClusters(groups)
+}
+
+// Parameters of Markov clustering iterations.
+const (
+	mclMaxIterations = 100
+	mclPrune         = 1e-5
+	mclEpsilon       = 1e-6
+)
+
+// MCL runs Markov clustering of the graph. Genes attracted to the same
+// attractor form a cluster.
+func (g *Graph) MCL(inflation float64) [][]int {
+	if inflation <= 1 {
+		inflation = 2
+	}
+	// columns of a sparse stochastic matrix, with self loops
+	m := make(map[int]map[int]float64, len(g.edges))
+	for id, nbs := range g.edges {
+		col := make(map[int]float64, len(nbs)+1)
+		max := 0.0
+		for nb, w := range nbs {
+			col[nb] = w
+			max = math.Max(max, w)
+		}
+		if max == 0 {
+			max = 1
+		}
+		col[id] = max
+		normalize(col)
+		m[id] = col
+	}
+
+	for i := 0; i < mclMaxIterations; i++ {
+		next := make(map[int]map[int]float64, len(m))
+		diff := 0.0
+		for j, col := range m {
+			// expansion, column j of m*m
+			res := make(map[int]float64)
+			for k, vk := range col {
+				for row, v := range m[k] {
+					res[row] += v * vk
+				}
+			}
+			// inflation and pruning
+			for row, v := range res {
+				res[row] = math.Pow(v, inflation)
+			}
+			normalize(res)
+			for row, v := range res {
+				if v < mclPrune {
+					delete(res, row)
+				}
+			}
+			normalize(res)
+			for row, v := range res {
+				diff = math.Max(diff, math.Abs(v-col[row]))
+			}
+			next[j] = res
+		}
+		m = next
+		if diff < mclEpsilon {
+			break
+		}
+	}
+
+	groups := make(map[int][]int)
+	for j, col := range m {
+		attractor, best := j, -1.0
+		for row, v := range col {
+			if v > best || (v == best && row < attractor) {
+				attractor, best = row, v
+			}
+		}
+		groups[attractor] = append(groups[attractor], j)
+	}
+	return sortClusters(groups)
+}
+
+func normalize(col map[int]float64) {
+	sum := 0.0
+	for _, v := range col {
+		sum += v
+	}
+	if sum == 0 {
+		return
+	}
+	for k, v := range col {
+		col[k] = v / sum
+	}
+}
+
+func sortClusters(groups map[int][]int) [][]int {
+	res := make([][]int, 0, len(groups))
+	for _, ids := range groups {
+		sort.Ints(ids)
+		res = append(res, ids)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		if len(res[i]) == len(res[j]) {
+			return res[i][0] < res[j][0]
+		}
+		return len(res[i]) > len(res[j])
+	})
+	return res
+}
+
+// SaveClusters stores cluster memberships and returns ID of the new
+// clustering.
+func SaveClusters(db *sql.DB, clusters [][]int, runIDs []int,
+	opts ClusterOptions) (id int, err error) {
+	transaction, err := db.Begin()
+	if err != nil {
+		return 0, dbError("start a transaction", err)
+	}
+	defer func() {
+		if err != nil {
+			transaction.Rollback()
+		}
+	}()
+
+	q := `INSERT INTO clusterings (method, weight, inflation, min_weight,
+	                               run_ids)
+	        VALUES ($1, $2, $3, $4, $5)
+	        RETURNING id`
+	err = transaction.QueryRow(q, opts.Method, opts.Weight, opts.Inflation,
+		opts.MinWeight, pq.Array(runIDs)).Scan(&id)
+	if err != nil {
+		return 0, dbError("create a clustering", err)
+	}
+
+	columns := []string{"clustering_id", "cluster_id", "gene_id"}
+	stmt, err := transaction.Prepare(pq.CopyIn("cluster_members", columns...))
+	if err != nil {
+		return 0, dbError("prepare clusters copy", err)
+	}
+	for i, cl := range clusters {
+		for _, geneID := range cl {
+			if _, err = stmt.Exec(id, i+1, geneID); err != nil {
+				return 0, dbError("copy clusters", err)
+			}
+		}
+	}
+	if _, err = stmt.Exec(); err != nil {
+		return 0, dbError("copy clusters", err)
+	}
+	if err = stmt.Close(); err != nil {
+		return 0, dbError("copy clusters", err)
+	}
+
+	err = transaction.Commit()
+	return id, dbError("commit clusters", err)
+}
+
+// GeneLabels returns labels of genes in "species|gene" form used by
+// OrthoMCL.
+func GeneLabels(db *sql.DB, ids []int) (map[int]string, error) {
+	res := make(map[int]string, len(ids))
+	q := `SELECT g.id, gn.species_short, g.gene
+	        FROM genes g
+	          JOIN genomes gn ON gn.id = g.genome_id
+	        WHERE g.id = ANY($1)`
+	rows, err := db.Query(q, pq.Array(ids))
+	if err != nil {
+		return nil, dbError("read gene labels", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id int
+		var species, gene string
+		if err := rows.Scan(&id, &species, &gene); err != nil {
+			return nil, dbError("read gene labels", err)
+		}
+		species = strings.Replace(species, " ", "", -1)
+		res[id] = species + "|" + gene
+	}
+	return res, dbError("read gene labels", rows.Err())
+}
+
+// WriteGroups writes clusters in OrthoMCL groups format, one cluster per
+// line: "prefix1000: species|gene1 species|gene2". Genes without labels
+// are written as IDs.
+func WriteGroups(w io.Writer, clusters [][]int, labels map[int]string,
+	prefix string) error {
+	for i, cl := range clusters {
+		genes := make([]string, len(cl))
+		for j, id := range cl {
+			if label, ok := labels[id]; ok {
+				genes[j] = label
+			} else {
+				genes[j] = fmt.Sprintf("%d", id)
+			}
+		}
+		_, err := fmt.Fprintf(w, "%s%d: %s\n", prefix, 1000+i,
+			strings.Join(genes, " "))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,87 @@
+package smithwatr
+
+import (
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"io"
+	"os"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+)
+
+// Magic bytes at the start of compressed files.
+var (
+	gzipMagic  = []byte{0x1f, 0x8b}
+	bzip2Magic = []byte("BZh")
+	xzMagic    = []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}
+	zstdMagic  = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+// openSequenceFile opens a file for reading and decompresses it if needed.
+// Compression is detected by the first bytes of the file, not by its
+// name. Plain, gzip, bzip2, xz and zstd files are supported.
+func openSequenceFile(path string) (io.ReadCloser, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	r, err := decompress(f)
+	if err != nil {
+		f.Close()
+		return nil, &ParseError{File: path, Err: err}
+	}
+	return r, nil
+}
+
+// decompress wraps a file into a decompressing reader. Closing the reader
+// closes the file as well.
+func decompress(f *os.File) (io.ReadCloser, error) {
+	br := bufio.NewReader(f)
+	magic, err := br.Peek(len(xzMagic))
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	var r io.Reader
+	closeFn := f.Close
+	switch {
+	case bytes.HasPrefix(magic, gzipMagic):
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, err
+		}
+		r = gz
+	case bytes.HasPrefix(magic, bzip2Magic):
+		r = bzip2.NewReader(br)
+	case bytes.HasPrefix(magic, xzMagic):
+		if r, err = xz.NewReader(br); err != nil {
+			return nil, err
+		}
+	case bytes.HasPrefix(magic, zstdMagic):
+		zr, err := zstd.NewReader(br)
+		if err != nil {
+			return nil, err
+		}
+		r = zr
+		closeFn = func() error {
+			zr.Close()
+			return f.Close()
+		}
+	default:
+		r = br
+	}
+	return &decompressor{Reader: r, close: closeFn}, nil
+}
+
+// decompressor is a reader of decompressed data that closes the underlying
+// file.
+type decompressor struct {
+	io.Reader
+	close func() error
+}
+
+func (d *decompressor) Close() error {
+	return d.close()
+}
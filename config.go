@@ -0,0 +1,486 @@
+package smithwatr
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v2"
+)
+
+// Sources of configuration values, in increasing precedence.
+const (
+	SourceDefault = "default"
+	SourceFile    = "file"
+	SourceEnv     = "env"
+	SourceFlag    = "flag"
+)
+
+// configEnv is an environment variable with a path to a config file. The
+// path can also be given with the -config flag.
+const configEnv = "SMITHWATR_CONFIG"
+
+// Setting is an effective value of a configuration key, and where it came
+// from. Values of secret keys, like passwords, are masked.
+type Setting struct {
+	Key    string
+	Env    string
+	Value  string
+	Source string
+}
+
+// setting describes a configuration key. The same key is used in config
+// files, and with dashes instead of underscores as a command line flag.
+type setting struct {
+	key string
+	env string
+	// oldEnv are deprecated names of the environment variable.
+	oldEnv []string
+	def    string
+	usage  string
+	// secret values are not shown by config show.
+	secret bool
+	set    func(*Env, string) error
+}
+
+var settings = []setting{
+	{key: "postgres_host", env: "POSTGRES_HOST", def: "localhost",
+		usage: "database host", set: func(e *Env, v string) error {
+			e.DbHost = v
+			return nil
+		}},
+	{key: "postgres_user", env: "POSTGRES_USER", def: "postgres",
+		usage: "database user", set: func(e *Env, v string) error {
+			e.DbUser = v
+			return nil
+		}},
+	{key: "postgres_db", env: "POSTGRES_DB", def: "smithwatr",
+		usage: "database name", set: func(e *Env, v string) error {
+			e.Db = v
+			return nil
+		}},
+	{key: "postgres_port", env: "POSTGRES_PORT", def: "5432",
+		usage: "database port", set: func(e *Env, v string) (err error) {
+			e.DbPort, err = parsePositive(v)
+			return err
+		}},
+	{key: "postgres_password", env: "POSTGRES_PASSWORD", secret: true,
+		usage: "database password", set: func(e *Env, v string) error {
+			e.DbPassword = v
+			return nil
+		}},
+	{key: "pgpassfile", env: "PGPASSFILE",
+		usage: "password file, ~/.pgpass is used if it is empty",
+		set: func(e *Env, v string) error {
+			e.DbPassFile = v
+			return nil
+		}},
+	{key: "postgres_sslmode", env: "POSTGRES_SSLMODE", def: "disable",
+		usage: "SSL mode: disable, require, verify-ca or verify-full",
+		set: func(e *Env, v string) (err error) {
+			e.DbSSLMode, err = parseOneOf(v, "disable", "require", "verify-ca",
+				"verify-full")
+			return err
+		}},
+	{key: "postgres_sslcert", env: "POSTGRES_SSLCERT",
+		usage: "client SSL certificate", set: func(e *Env, v string) error {
+			e.DbSSLCert = v
+			return nil
+		}},
+	{key: "postgres_sslkey", env: "POSTGRES_SSLKEY",
+		usage: "client SSL key", set: func(e *Env, v string) error {
+			e.DbSSLKey = v
+			return nil
+		}},
+	{key: "postgres_sslrootcert", env: "POSTGRES_SSLROOTCERT",
+		usage: "SSL certificate of the certificate authority",
+		set: func(e *Env, v string) error {
+			e.DbSSLRootCert = v
+			return nil
+		}},
+	{key: "postgres_application_name", env: "POSTGRES_APPLICATION_NAME",
+		def: "smithwatr", usage: "application name shown by the database",
+		set: func(e *Env, v string) error {
+			e.DbAppName = v
+			return nil
+		}},
+	{key: "postgres_dsn", env: "POSTGRES_DSN", secret: true,
+		usage: "connection URL or string, replaces other postgres settings",
+		set: func(e *Env, v string) error {
+			e.DbDSN = v
+			return nil
+		}},
+	{key: "postgres_max_open_conns", env: "POSTGRES_MAX_OPEN_CONNS", def: "0",
+		usage: "max open database connections, 0 means no limit",
+		set: func(e *Env, v string) (err error) {
+			e.DbMaxOpenConns, err = parseCount(v)
+			return err
+		}},
+	{key: "postgres_max_idle_conns", env: "POSTGRES_MAX_IDLE_CONNS", def: "2",
+		usage: "max idle database connections",
+		set: func(e *Env, v string) (err error) {
+			e.DbMaxIdleConns, err = parseCount(v)
+			return err
+		}},
+	{key: "postgres_connect_retries", env: "POSTGRES_CONNECT_RETRIES",
+		def:   "5",
+		usage: "how many times connecting to the database is repeated",
+		set: func(e *Env, v string) (err error) {
+			e.DbConnectRetries, err = parseCount(v)
+			return err
+		}},
+	{key: "data_dir", env: "DATA_DIR", def: "./scripts/data",
+		usage: "directory of genome files", set: func(e *Env, v string) error {
+			e.DataDir = v
+			return nil
+		}},
+	{key: "gap_open_penalty", env: "GAP_OPEN_PENALTY",
+		oldEnv: []string{"GAP_OPEN_PENTALTY"}, def: "10",
+		usage: "penalty for opening a gap", set: func(e *Env, v string) (err error) {
+			e.GapOpens, err = parseCount(v)
+			return err
+		}},
+	{key: "gap_extension_penalty", env: "GAP_EXTENSION_PENALTY", def: "1",
+		usage: "penalty for extending a gap", set: func(e *Env, v string) (err error) {
+			e.GapExtends, err = parseCount(v)
+			return err
+		}},
+	{key: "cpu_capacity", env: "CPU_CAPACITY", def: "0.8",
+		usage: "share of CPUs used for alignment, from 0 to 1",
+		set: func(e *Env, v string) (err error) {
+			e.WorkersNum, err = calculateWorkersNum(v)
+			return err
+		}},
+	{key: "memory_budget", env: "MEMORY_BUDGET", def: "0",
+		usage: "memory for score matrices, like 4GB, 0 means no limit",
+		set: func(e *Env, v string) (err error) {
+			e.MemoryBudget, err = parseBytes(v)
+			return err
+		}},
+	{key: "job_lease", env: "JOB_LEASE", def: defaultJobLease.String(),
+		usage: "time after which jobs of a silent worker are reclaimed",
+		set: func(e *Env, v string) (err error) {
+			e.JobLease, err = parsePositiveDuration(v)
+			return err
+		}},
+	{key: "save_batch_size", env: "SAVE_BATCH_SIZE",
+		def:   strconv.Itoa(defaultSaveBatchSize),
+		usage: "max number of alignments saved in one transaction",
+		set: func(e *Env, v string) (err error) {
+			e.SaveBatchSize, err = parsePositive(v)
+			return err
+		}},
+	{key: "save_interval", env: "SAVE_INTERVAL",
+		def:   defaultSaveInterval.String(),
+		usage: "max time alignments wait before they are saved",
+		set: func(e *Env, v string) (err error) {
+			e.SaveInterval, err = parsePositiveDuration(v)
+			return err
+		}},
+	{key: "save_retries", env: "SAVE_RETRIES",
+		def:   strconv.Itoa(defaultSaveRetries),
+		usage: "how many times a failed save is repeated",
+		set: func(e *Env, v string) (err error) {
+			e.SaveRetries, err = parseCount(v)
+			return err
+		}},
+	{key: "top_n", env: "TOP_N", def: "0",
+		usage: "number of best hits kept for every query gene, 0 keeps all " +
+			"(ignored in self comparisons)",
+		set: func(e *Env, v string) (err error) {
+			e.TopN, err = parseCount(v)
+			return err
+		}},
+	{key: "min_score", env: "MIN_SCORE", def: "0",
+		usage: "smallest score of a kept hit", set: func(e *Env, v string) (err error) {
+			e.MinScore, err = parseCount(v)
+			return err
+		}},
+	{key: "min_identity", env: "MIN_IDENTITY", def: "0",
+		usage: "smallest identity percent of a kept hit",
+		set: func(e *Env, v string) error {
+			res, err := parsePercent(v)
+			e.MinIdentity = float32(res)
+			return err
+		}},
+	{key: "max_evalue", env: "MAX_EVALUE", def: "0",
+		usage: "largest E-value of a kept hit, 0 means no limit",
+		set: func(e *Env, v string) (err error) {
+			e.MaxEvalue, err = parseNonNegative(v)
+			return err
+		}},
+	{key: "fasta_strict", env: "FASTA_STRICT", def: "false",
+		usage: "stop import on any problem in FASTA files",
+		set: func(e *Env, v string) (err error) {
+			e.StrictFasta, err = strconv.ParseBool(v)
+			return err
+		}},
+	{key: "longest_isoform", env: "LONGEST_ISOFORM", def: "false",
+		usage: "align only the longest isoform of every gene",
+		set: func(e *Env, v string) (err error) {
+			e.LongestIsoform, err = strconv.ParseBool(v)
+			return err
+		}},
+	{key: "rbh_ties", env: "RBH_TIES", def: TiesAll,
+		usage: "tied best hits: all, none or first",
+		set: func(e *Env, v string) (err error) {
+			e.RBH.Ties, err = parseOneOf(v, TiesAll, TiesNone, TiesFirst)
+			return err
+		}},
+	{key: "rbh_min_score", env: "RBH_MIN_SCORE", def: "0",
+		usage: "smallest score of reciprocal best hits",
+		set: func(e *Env, v string) (err error) {
+			e.RBH.MinScore, err = parseCount(v)
+			return err
+		}},
+	{key: "rbh_min_coverage", env: "RBH_MIN_COVERAGE", def: "0",
+		usage: "smallest coverage percent of reciprocal best hits",
+		set: func(e *Env, v string) error {
+			res, err := parsePercent(v)
+			e.RBH.MinCoverage = float32(res)
+			return err
+		}},
+	{key: "cluster_weight", env: "CLUSTER_WEIGHT", def: WeightBitScore,
+		usage: "weight of cluster graph edges: bitscore or identity",
+		set: func(e *Env, v string) (err error) {
+			e.Cluster.Weight, err = parseOneOf(v, WeightBitScore, WeightIdentity)
+			return err
+		}},
+	{key: "cluster_min_weight", env: "CLUSTER_MIN_WEIGHT", def: "0",
+		usage: "smallest weight of cluster graph edges",
+		set: func(e *Env, v string) (err error) {
+			e.Cluster.MinWeight, err = parseNonNegative(v)
+			return err
+		}},
+	{key: "mcl_inflation", env: "MCL_INFLATION", def: "2",
+		usage: "inflation of Markov clustering, larger than 1",
+		set: func(e *Env, v string) (err error) {
+			e.Cluster.Inflation, err = strconv.ParseFloat(v, 64)
+			if err == nil && e.Cluster.Inflation <= 1 {
+				err = fmt.Errorf("%g is not larger than 1", e.Cluster.Inflation)
+			}
+			return err
+		}},
+}
+
+// EnvVars reads configuration from defaults, a config file from
+// SMITHWATR_CONFIG, and environment variables.
+func EnvVars() (Env, error) {
+	env, _, _, err := LoadConfig(nil)
+	return env, err
+}
+
+// LoadConfig reads configuration from defaults, a config file, environment
+// variables and command line flags in args, each overriding the previous
+// one. Flags have to go before other arguments, which are returned. The
+// config file is set by -config flag or SMITHWATR_CONFIG variable, its
+// format is YAML, or TOML if its name ends with .toml.
+func LoadConfig(args []string) (Env, []Setting, []string, error) {
+	env := Env{Cluster: ClusterOptions{Method: MethodMCL}}
+	vals := make(map[string]Setting)
+	for _, s := range settings {
+		vals[s.key] = Setting{Key: s.key, Env: s.env, Value: s.def,
+			Source: SourceDefault}
+	}
+
+	fs := flag.NewFlagSet("smithwatr", flag.ContinueOnError)
+	configPath := fs.String("config", os.Getenv(configEnv),
+		"YAML or TOML config file")
+	for _, s := range settings {
+		fs.String(strings.Replace(s.key, "_", "-", -1), "",
+			fmt.Sprintf("%s (%s)", s.usage, s.env))
+	}
+	if err := fs.Parse(args); err != nil {
+		return env, nil, nil, err
+	}
+
+	if *configPath != "" {
+		file, err := readConfigFile(*configPath)
+		if err != nil {
+			return env, nil, nil, err
+		}
+		for key, val := range file {
+			s := vals[key]
+			s.Value, s.Source = val, SourceFile
+			vals[key] = s
+		}
+	}
+
+	for _, s := range settings {
+		names := append([]string{s.env}, s.oldEnv...)
+		for i := len(names) - 1; i >= 0; i-- {
+			val, ok := os.LookupEnv(names[i])
+			if !ok {
+				continue
+			}
+			if i > 0 {
+				log.Printf("Warning: %s is deprecated, use %s", names[i], s.env)
+			}
+			v := vals[s.key]
+			v.Value, v.Source, v.Env = val, SourceEnv, names[i]
+			vals[s.key] = v
+		}
+	}
+
+	fs.Visit(func(f *flag.Flag) {
+		key := strings.Replace(f.Name, "-", "_", -1)
+		if v, ok := vals[key]; ok {
+			v.Value, v.Source = f.Value.String(), SourceFlag
+			vals[key] = v
+		}
+	})
+
+	res := make([]Setting, 0, len(settings))
+	for _, s := range settings {
+		v := vals[s.key]
+		if err := s.set(&env, v.Value); err != nil {
+			if v.Source == SourceEnv {
+				return env, nil, nil, &EnvError{Var: v.Env, Err: err}
+			}
+			return env, nil, nil, &ConfigError{Key: s.key, Source: v.Source,
+				Err: err}
+		}
+		if s.secret && v.Value != "" {
+			v.Value = "********"
+		}
+		res = append(res, v)
+	}
+	return env, res, fs.Args(), nil
+}
+
+// readConfigFile reads a flat YAML or TOML file with configuration keys.
+func readConfigFile(path string) (map[string]string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	raw := make(map[string]interface{})
+	if strings.EqualFold(filepath.Ext(path), ".toml") {
+		err = toml.Unmarshal(data, &raw)
+	} else {
+		err = yaml.Unmarshal(data, &raw)
+	}
+	if err != nil {
+		return nil, &ParseError{File: path, Err: err}
+	}
+	known := make(map[string]bool)
+	for _, s := range settings {
+		known[s.key] = true
+	}
+	res := make(map[string]string)
+	var unknown []string
+	for k, v := range raw {
+		if !known[k] {
+			unknown = append(unknown, k)
+			continue
+		}
+		res[k] = fmt.Sprint(v)
+	}
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		return nil, &ParseError{File: path, Err: fmt.Errorf("unknown keys %s",
+			strings.Join(unknown, ", "))}
+	}
+	return res, nil
+}
+
+// parseCount parses a non-negative integer.
+func parseCount(v string) (int, error) {
+	res, err := strconv.Atoi(v)
+	if err == nil && res < 0 {
+		err = fmt.Errorf("%d is negative", res)
+	}
+	return res, err
+}
+
+// parsePositive parses an integer larger than 0.
+func parsePositive(v string) (int, error) {
+	res, err := strconv.Atoi(v)
+	if err == nil && res < 1 {
+		err = fmt.Errorf("%d is not positive", res)
+	}
+	return res, err
+}
+
+// parseNonNegative parses a float that is not negative.
+func parseNonNegative(v string) (float64, error) {
+	res, err := strconv.ParseFloat(v, 64)
+	if err == nil && res < 0 {
+		err = fmt.Errorf("%g is negative", res)
+	}
+	return res, err
+}
+
+// parsePercent parses a float from 0 to 100.
+func parsePercent(v string) (float64, error) {
+	res, err := parseNonNegative(v)
+	if err == nil && res > 100 {
+		err = fmt.Errorf("%g is larger than 100 percent", res)
+	}
+	return res, err
+}
+
+// parseBytes parses a size in bytes with an optional unit, like 512MB or
+// 4GB. Units are powers of 1024.
+func parseBytes(v string) (int64, error) {
+	units := []struct {
+		suffix string
+		size   float64
+	}{{"TB", 1 << 40}, {"GB", 1 << 30}, {"MB", 1 << 20}, {"KB", 1 << 10},
+		{"B", 1}}
+	num, size := strings.ToUpper(strings.TrimSpace(v)), 1.0
+	for _, u := range units {
+		if strings.HasSuffix(num, u.suffix) {
+			num, size = strings.TrimSpace(strings.TrimSuffix(num, u.suffix)),
+				u.size
+			break
+		}
+	}
+	res, err := parseNonNegative(num)
+	if err != nil {
+		return 0, err
+	}
+	return int64(res * size), nil
+}
+
+// parsePositiveDuration parses a duration like "30s" that is larger than 0.
+func parsePositiveDuration(v string) (time.Duration, error) {
+	res, err := time.ParseDuration(v)
+	if err == nil && res <= 0 {
+		err = fmt.Errorf("%s is not positive", res)
+	}
+	return res, err
+}
+
+// parseOneOf checks that a value is one of the allowed values.
+func parseOneOf(v string, allowed ...string) (string, error) {
+	for _, a := range allowed {
+		if v == a {
+			return v, nil
+		}
+	}
+	return v, fmt.Errorf("%q is not one of %s", v, strings.Join(allowed, ", "))
+}
+
+func calculateWorkersNum(cpuLoad string) (int, error) {
+	load, err := strconv.ParseFloat(cpuLoad, 64)
+	if err == nil && (load <= 0 || load > 1) {
+		err = fmt.Errorf("%g is not between 0 and 1", load)
+	}
+	if err != nil {
+		return 0, err
+	}
+	cpuNum := runtime.NumCPU()
+	workersNum := int(math.Ceil(float64(cpuNum) * load))
+	return workersNum, nil
+}
@@ -0,0 +1,155 @@
+package smithwatr
+
+import (
+	"bufio"
+	"database/sql"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	_ "github.com/lib/pq"
+)
+
+// Connect opens a pool of database connections and checks that the
+// database is reachable. If it is not, connecting is repeated up to
+// conf.DbConnectRetries times with growing pauses, so the program can
+// start together with the database.
+func Connect(conf Env) (*sql.DB, error) {
+	params, err := ConnString(conf)
+	if err != nil {
+		return nil, err
+	}
+	db, err := sql.Open("postgres", params)
+	if err != nil {
+		return nil, dbError("connect", err)
+	}
+	db.SetMaxOpenConns(conf.DbMaxOpenConns)
+	db.SetMaxIdleConns(conf.DbMaxIdleConns)
+
+	pause := time.Second
+	for i := 0; ; i++ {
+		err = dbError("connect", db.Ping())
+		if err == nil {
+			return db, nil
+		}
+		if i >= conf.DbConnectRetries || !isTransient(err) {
+			db.Close()
+			return nil, err
+		}
+		log.Printf("Database is not reachable, retry in %s: %s", pause, err)
+		time.Sleep(pause)
+		pause *= 2
+	}
+}
+
+// ConnString returns a connection URL for the database. It is conf.DbDSN
+// if that is set, otherwise it is built from the other connection
+// settings. Without a password the password file is searched for one.
+func ConnString(conf Env) (string, error) {
+	if conf.DbDSN != "" {
+		return conf.DbDSN, nil
+	}
+	port := strconv.Itoa(conf.DbPort)
+	password := conf.DbPassword
+	if password == "" {
+		var err error
+		password, err = passFilePassword(conf.DbPassFile, conf.DbHost, port,
+			conf.Db, conf.DbUser)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	u := url.URL{Scheme: "postgres", User: url.User(conf.DbUser),
+		Host: net.JoinHostPort(conf.DbHost, port), Path: "/" + conf.Db}
+	if password != "" {
+		u.User = url.UserPassword(conf.DbUser, password)
+	}
+	q := url.Values{}
+	q.Set("sslmode", conf.DbSSLMode)
+	params := map[string]string{"sslcert": conf.DbSSLCert,
+		"sslkey": conf.DbSSLKey, "sslrootcert": conf.DbSSLRootCert,
+		"application_name": conf.DbAppName}
+	for k, v := range params {
+		if v != "" {
+			q.Set(k, v)
+		}
+	}
+	u.RawQuery = q.Encode()
+	return u.String(), nil
+}
+
+// passFilePassword finds a password in a file of the ~/.pgpass format,
+// where every line is host:port:database:user:password, and * matches
+// anything. The first matching line wins. If path is empty, ~/.pgpass is
+// used when it exists.
+func passFilePassword(path string, host string, port string, db string,
+	user string) (string, error) {
+	if path == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", nil
+		}
+		path = filepath.Join(home, ".pgpass")
+		if _, err := os.Stat(path); err != nil {
+			return "", nil
+		}
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	want := []string{host, port, db, user}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := splitPassLine(line)
+		if len(fields) != 5 {
+			continue
+		}
+		match := true
+		for i, w := range want {
+			if fields[i] != "*" && fields[i] != w {
+				match = false
+				break
+			}
+		}
+		if match {
+			return fields[4], nil
+		}
+	}
+	return "", scanner.Err()
+}
+
+// splitPassLine splits a line of a password file by colons. A backslash
+// escapes a colon or a backslash.
+func splitPassLine(line string) []string {
+	var res []string
+	var field strings.Builder
+	escaped := false
+	for _, r := range line {
+		switch {
+		case escaped:
+			field.WriteRune(r)
+			escaped = false
+		case r == '\\':
+			escaped = true
+		case r == ':' && len(res) < 4:
+			res = append(res, field.String())
+			field.Reset()
+		default:
+			field.WriteRune(r)
+		}
+	}
+	return append(res, field.String())
+}
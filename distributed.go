@@ -0,0 +1,459 @@
+package smithwatr
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// wireGene is a representation of a Gene sent between a coordinator and
+// its workers.
+type wireGene struct {
+	ID       int    `json:"id"`
+	GenomeID int    `json:"genome_id"`
+	Gene     string `json:"gene"`
+	Seq      string `json:"seq"`
+}
+
+// workBatch is a set of query genes of a run that a worker has to align
+// against all genes of the target genome.
+type workBatch struct {
+	RunID          int           `json:"run_id"`
+	TargetGenomeID int           `json:"target_genome_id"`
+	GapOpens       int           `json:"gap_open"`
+	GapExtends     int           `json:"gap_extend"`
+	LongestIsoform bool          `json:"longest_isoform"`
+	Lease          time.Duration `json:"lease"`
+	Genes          []wireGene    `json:"genes"`
+}
+
+// wireResult is a result of one alignment computed by a worker.
+type wireResult struct {
+	GeneID       int     `json:"gene_id"`
+	GeneLen      int     `json:"gene_len"`
+	MatchGeneID  int     `json:"match_gene_id"`
+	MatchGeneLen int     `json:"match_gene_len"`
+	Score        int     `json:"score"`
+	Identical    int     `json:"identical"`
+	Similar      int     `json:"similar"`
+	Coverage1    float32 `json:"coverage1"`
+	Coverage2    float32 `json:"coverage2"`
+}
+
+// resultBatch contains all alignments of every gene of a workBatch.
+type resultBatch struct {
+	RunID   int          `json:"run_id"`
+	GeneIDs []int        `json:"gene_ids"`
+	Results []wireResult `json:"results"`
+}
+
+// heartbeatMsg renews leases of the jobs a worker is busy with.
+type heartbeatMsg struct {
+	RunID   int   `json:"run_id"`
+	GeneIDs []int `json:"gene_ids"`
+}
+
+// genomeKey identifies a set of target genes: all genes of a genome, or
+// only their longest isoforms.
+type genomeKey struct {
+	id      int
+	longest bool
+}
+
+func toWireGene(g Gene) wireGene {
+	return wireGene{ID: g.ID, GenomeID: g.GenomeID, Gene: g.Gene,
+		Seq: string(g.Seq)}
+}
+
+func fromWireGene(wg wireGene) Gene {
+	seq := []rune(wg.Seq)
+	return Gene{ID: wg.ID, GenomeID: wg.GenomeID, Gene: wg.Gene, Seq: seq,
+		SeqLen: len(seq)}
+}
+
+// Coordinator hands out batches of jobs of its runs to remote workers over
+// HTTP and saves the results workers send back. Jobs of workers that stop
+// sending heartbeats are reclaimed after the lease time.
+type Coordinator struct {
+	db   *sql.DB
+	runs []Run
+	// limit is the number of target genes sent to workers, as in Align
+	limit int
+	conf  Env
+	mux   *http.ServeMux
+	mu    sync.Mutex
+	// dbLens caches the number of residues in target genomes
+	dbLens map[genomeKey]int
+}
+
+// NewCoordinator creates an HTTP handler that distributes jobs of the
+// given runs. If limit is positive, only first limit genes of target
+// genomes are aligned.
+func NewCoordinator(db *sql.DB, runs []Run, limit int,
+	conf Env) *Coordinator {
+	c := &Coordinator{db: db, runs: runs, limit: limit, conf: conf,
+		mux: http.NewServeMux(), dbLens: make(map[genomeKey]int)}
+	c.mux.HandleFunc("/claim", c.claim)
+	c.mux.HandleFunc("/genomes/", c.genome)
+	c.mux.HandleFunc("/results", c.results)
+	c.mux.HandleFunc("/heartbeat", c.heartbeat)
+	return c
+}
+
+func (c *Coordinator) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	c.mux.ServeHTTP(w, r)
+}
+
+// claim responds with a batch of jobs, or with 204 status if all jobs of
+// all runs are taken.
+func (c *Coordinator) claim(w http.ResponseWriter, r *http.Request) {
+	num, err := strconv.Atoi(r.URL.Query().Get("num"))
+	if err != nil || num < 1 {
+		num = 1
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, err = ReclaimJobs(c.db, c.conf.JobLease); err != nil {
+		serverError(w, err)
+		return
+	}
+	for _, run := range c.runs {
+		batch := workBatch{RunID: run.ID, TargetGenomeID: run.TargetGenomeID,
+			GapOpens: run.GapOpens, GapExtends: run.GapExtends,
+			LongestIsoform: run.LongestIsoform, Lease: c.conf.JobLease}
+		for i := 0; i < num; i++ {
+			gene, err := getAJob(c.db, run.ID)
+			if err != nil {
+				serverError(w, err)
+				return
+			}
+			if gene.ID == 0 {
+				break
+			}
+			batch.Genes = append(batch.Genes, toWireGene(gene))
+		}
+		if len(batch.Genes) > 0 {
+			writeJSON(w, batch)
+			return
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (c *Coordinator) genome(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/genomes/"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	longest := r.URL.Query().Get("longest") == "true"
+	genes, err := GetGenome(c.db, id, c.limit, longest)
+	if err != nil {
+		serverError(w, err)
+		return
+	}
+	res := make([]wireGene, len(genes))
+	for i, g := range genes {
+		res[i] = toWireGene(g)
+	}
+	writeJSON(w, res)
+}
+
+func (c *Coordinator) results(w http.ResponseWriter, r *http.Request) {
+	var rb resultBatch
+	if err := json.NewDecoder(r.Body).Decode(&rb); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	hf, err := c.hitFilter(rb.RunID)
+	if err != nil {
+		serverError(w, err)
+		return
+	}
+	var gms []Alignment
+	for _, res := range rb.Results {
+		gms = append(gms, hf.add(Alignment{
+			Gene1: Gene{ID: res.GeneID, SeqLen: res.GeneLen},
+			Gene2: Gene{ID: res.MatchGeneID, SeqLen: res.MatchGeneLen},
+			Score: res.Score, Identical: res.Identical, Similar: res.Similar,
+			Coverage1: res.Coverage1, Coverage2: res.Coverage2})...)
+	}
+	for _, id := range rb.GeneIDs {
+		gms = append(gms, hf.flush(id)...)
+	}
+	err = saveWithRetry(c.db, rb.RunID, gms, rb.GeneIDs, c.conf.SaveRetries)
+	if err != nil {
+		serverError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// hitFilter creates a filter for results of one of the coordinator's runs.
+func (c *Coordinator) hitFilter(runID int) (*hitFilter, error) {
+	for _, run := range c.runs {
+		if run.ID != runID {
+			continue
+		}
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		key := genomeKey{run.TargetGenomeID, run.LongestIsoform}
+		dbLen, ok := c.dbLens[key]
+		if !ok {
+			var err error
+			dbLen, err = genomeLength(c.db, key.id, key.longest)
+			if err != nil {
+				return nil, err
+			}
+			c.dbLens[key] = dbLen
+		}
+		return newHitFilter(run.apply(c.conf), dbLen), nil
+	}
+	return nil, fmt.Errorf("Run %d is not served by the coordinator", runID)
+}
+
+func (c *Coordinator) heartbeat(w http.ResponseWriter, r *http.Request) {
+	var hb heartbeatMsg
+	if err := json.NewDecoder(r.Body).Decode(&hb); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	lk := &leaseKeeper{db: c.db, runID: hb.RunID, ids: make(map[int]struct{})}
+	for _, id := range hb.GeneIDs {
+		lk.add(id)
+	}
+	if err := lk.renew(); err != nil {
+		serverError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func serverError(w http.ResponseWriter, err error) {
+	log.Println(err)
+	http.Error(w, err.Error(), http.StatusInternalServerError)
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(v)
+	if err != nil {
+		log.Printf("Cannot send response: %s", err)
+	}
+}
+
+// coordinatorClient sends requests of workers to a coordinator. The
+// timeout covers a whole request, including a download of a genome, so a
+// coordinator that hangs does not block a worker forever.
+var coordinatorClient = &http.Client{Timeout: 5 * time.Minute}
+
+// RunWorker takes batches of jobs from a coordinator at url, aligns them
+// with conf.WorkersNum goroutines within conf.MemoryBudget, and sends
+// results back, until the coordinator has no more jobs. When ctx is
+// cancelled the worker drops its current batch and stops, the coordinator
+// gives the jobs of the batch to other workers after their lease expires.
+func RunWorker(ctx context.Context, url string, b62 Blosum62,
+	conf Env) error {
+	url = strings.TrimRight(url, "/")
+	genomes := make(map[genomeKey][]Gene)
+	ms := NewMemoryScheduler(conf.MemoryBudget, conf.WorkersNum)
+	for ctx.Err() == nil {
+		batch, ok, err := claimBatch(ctx, url, conf.WorkersNum)
+		if ctx.Err() != nil {
+			break
+		}
+		if err != nil || !ok {
+			return err
+		}
+		key := genomeKey{batch.TargetGenomeID, batch.LongestIsoform}
+		targets, cached := genomes[key]
+		if !cached {
+			targets, err = fetchGenome(ctx, url, key)
+			if ctx.Err() != nil {
+				break
+			}
+			if err != nil {
+				return err
+			}
+			longestFirst(targets)
+			genomes[key] = targets
+		}
+		log.Printf("Run %d: aligning %d genes against %d targets",
+			batch.RunID, len(batch.Genes), len(targets))
+
+		rb := resultBatch{RunID: batch.RunID}
+		for _, g := range batch.Genes {
+			rb.GeneIDs = append(rb.GeneIDs, g.ID)
+		}
+		stop := make(chan struct{})
+		go sendHeartbeats(ctx, url, heartbeatMsg{RunID: batch.RunID,
+			GeneIDs: rb.GeneIDs}, batch.Lease/3, stop)
+
+		conf.GapOpens = batch.GapOpens
+		conf.GapExtends = batch.GapExtends
+		for _, wg := range batch.Genes {
+			if ctx.Err() != nil {
+				break
+			}
+			gene := fromWireGene(wg)
+			pairs := pairTargets(gene, targets)
+			for _, a := range alignGene(ctx, gene, pairs, b62, conf, ms) {
+				rb.Results = append(rb.Results, wireResult{
+					GeneID: a.Gene1.ID, GeneLen: a.Gene1.SeqLen,
+					MatchGeneID: a.Gene2.ID, MatchGeneLen: a.Gene2.SeqLen,
+					Score: a.Score, Identical: a.Identical, Similar: a.Similar,
+					Coverage1: a.Coverage1, Coverage2: a.Coverage2})
+			}
+		}
+		if ctx.Err() != nil {
+			close(stop)
+			break
+		}
+		err = post(ctx, url+"/results", rb)
+		close(stop)
+		if ctx.Err() != nil {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	log.Println("Worker is interrupted")
+	return nil
+}
+
+// alignGene aligns a gene against all targets using conf.WorkersNum
+// goroutines, which take work units of targets admitted by the memory
+// scheduler. When ctx is cancelled units that are not started are
+// skipped, so the result is incomplete.
+func alignGene(ctx context.Context, gene Gene, targets []Gene,
+	b62 Blosum62, conf Env, ms *MemoryScheduler) []Alignment {
+	units := workUnits(gene, targets)
+	unitRes := make([][]Alignment, len(units))
+	idx := make(chan int)
+	var wg sync.WaitGroup
+	for i := 0; i < conf.WorkersNum; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			m := ms.matcher()
+			defer m.release(ms)
+			for k := range idx {
+				for _, t := range units[k].targets {
+					unitRes[k] = append(unitRes[k],
+						m.alignWithin(ms, gene, t, b62, conf))
+				}
+			}
+		}()
+	}
+	for k := range units {
+		if ctx.Err() != nil {
+			break
+		}
+		idx <- k
+	}
+	close(idx)
+	wg.Wait()
+	res := make([]Alignment, 0, len(targets))
+	for _, r := range unitRes {
+		res = append(res, r...)
+	}
+	return res
+}
+
+func claimBatch(ctx context.Context, url string,
+	num int) (workBatch, bool, error) {
+	var batch workBatch
+	resp, err := send(ctx, http.MethodPost,
+		fmt.Sprintf("%s/claim?num=%d", url, num), nil)
+	if err != nil {
+		return batch, false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNoContent {
+		return batch, false, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return batch, false, fmt.Errorf("Coordinator responded with %s",
+			resp.Status)
+	}
+	err = json.NewDecoder(resp.Body).Decode(&batch)
+	return batch, err == nil, err
+}
+
+func fetchGenome(ctx context.Context, url string,
+	key genomeKey) ([]Gene, error) {
+	var wgs []wireGene
+	resp, err := send(ctx, http.MethodGet,
+		fmt.Sprintf("%s/genomes/%d?longest=%t", url, key.id, key.longest), nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Coordinator responded with %s", resp.Status)
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&wgs); err != nil {
+		return nil, err
+	}
+	res := make([]Gene, len(wgs))
+	for i, wg := range wgs {
+		res[i] = fromWireGene(wg)
+	}
+	return res, nil
+}
+
+func sendHeartbeats(ctx context.Context, url string, hb heartbeatMsg,
+	period time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(period)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			if err := post(ctx, url+"/heartbeat", hb); err != nil {
+				log.Printf("Heartbeat failed: %s", err)
+			}
+		}
+	}
+}
+
+func post(ctx context.Context, url string, v interface{}) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	resp, err := send(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("Coordinator responded with %s", resp.Status)
+	}
+	return nil
+}
+
+// send makes a request to a coordinator that is cancelled with ctx.
+func send(ctx context.Context, method string, url string,
+	body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, url, body)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	return coordinatorClient.Do(req)
+}
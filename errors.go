@@ -0,0 +1,113 @@
+package smithwatr
+
+import (
+	"database/sql/driver"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// EnvError is returned when environment variables are missing or have
+// values that cannot be used.
+type EnvError struct {
+	Missing []string
+	Var     string
+	Err     error
+}
+
+func (e *EnvError) Error() string {
+	if len(e.Missing) > 0 {
+		return fmt.Sprintf("Environment variables %s are not defined",
+			strings.Join(e.Missing, ", "))
+	}
+	return fmt.Sprintf("Environment variable %s is invalid: %s", e.Var, e.Err)
+}
+
+func (e *EnvError) Unwrap() error {
+	return e.Err
+}
+
+// ParseError is returned when an input file cannot be parsed. Line is 0
+// when the problem is not related to a particular line.
+type ParseError struct {
+	File string
+	Line int
+	Err  error
+}
+
+func (e *ParseError) Error() string {
+	if e.Line > 0 {
+		return fmt.Sprintf("Cannot parse %s, line %d: %s", e.File, e.Line, e.Err)
+	}
+	return fmt.Sprintf("Cannot parse %s: %s", e.File, e.Err)
+}
+
+func (e *ParseError) Unwrap() error {
+	return e.Err
+}
+
+// DBError is returned when a database operation fails. Op describes what
+// was attempted.
+type DBError struct {
+	Op  string
+	Err error
+}
+
+func (e *DBError) Error() string {
+	return fmt.Sprintf("Database error, cannot %s: %s", e.Op, e.Err)
+}
+
+func (e *DBError) Unwrap() error {
+	return e.Err
+}
+
+// dbError wraps err into DBError, nil errors stay nil.
+func dbError(op string, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &DBError{Op: op, Err: err}
+}
+
+// isTransient returns true for database errors that might go away if the
+// operation is repeated, like lost connections, deadlocks or
+// serialization failures.
+func isTransient(err error) bool {
+	if dbErr, ok := err.(*DBError); ok {
+		err = dbErr.Err
+	}
+	if err == driver.ErrBadConn {
+		return true
+	}
+	if _, ok := err.(net.Error); ok {
+		return true
+	}
+	if pqErr, ok := err.(*pq.Error); ok {
+		switch pqErr.Code.Class() {
+		// connection exception, transaction rollback, insufficient resources,
+		// operator intervention
+		case "08", "40", "53", "57":
+			return true
+		}
+	}
+	return false
+}
+
+// ConfigError is returned when a configuration key from a config file or a
+// command line flag has a value that cannot be used.
+type ConfigError struct {
+	Key    string
+	Source string
+	Err    error
+}
+
+func (e *ConfigError) Error() string {
+	return fmt.Sprintf("Configuration %s from %s is invalid: %s", e.Key,
+		e.Source, e.Err)
+}
+
+func (e *ConfigError) Unwrap() error {
+	return e.Err
+}
@@ -0,0 +1,34 @@
+package smithwatr
+
+// UnitCells and LongestFirst let specs check how work is partitioned.
+const UnitCells = unitCells
+
+var LongestFirst = longestFirst
+
+// WorkUnitTargets returns targets of every work unit of a gene.
+func WorkUnitTargets(gene Gene, targets []Gene) [][]Gene {
+	var res [][]Gene
+	for _, u := range workUnits(gene, targets) {
+		res = append(res, u.targets)
+	}
+	return res
+}
+
+// WorkerMatcher returns a Matcher a worker uses with the scheduler.
+func WorkerMatcher(ms *MemoryScheduler) *Matcher {
+	m := ms.matcher()
+	return &m
+}
+
+// AlignWithin aligns a pair within the budget of ms, and returns bytes of
+// the buffer the Matcher keeps and bytes it has reserved for it in ms.
+func (m *Matcher) AlignWithin(ms *MemoryScheduler, g1 Gene, g2 Gene,
+	b62 Blosum62, conf Env) (int64, int64) {
+	m.alignWithin(ms, g1, g2, b62, conf)
+	return m.kept(), m.held
+}
+
+// Release drops the buffer of the Matcher.
+func (m *Matcher) Release(ms *MemoryScheduler) {
+	m.release(ms)
+}
@@ -0,0 +1,149 @@
+package smithwatr
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+)
+
+// residues are amino acid codes of the BLOSUM62 matrix, including stop.
+const residues = "ARNDCQEGHILKMFPSTWYVBZX*"
+
+// FastaParser reads protein records of a FASTA file. Blank lines, Windows
+// line endings, lowercase residues and lines of any length are accepted.
+// A stop codon at the end of a sequence is removed.
+//
+// Other problems, like invalid characters, stop codons inside a sequence,
+// empty sequences, or a sequence without a header, are errors in strict
+// mode. In lenient mode they are reported to Warn and fixed: invalid
+// characters are replaced with X, records without sequence are skipped.
+type FastaParser struct {
+	// Path is the file name used in errors and warnings.
+	Path   string
+	Strict bool
+	// Warn receives problems found in lenient mode. If it is nil, warnings
+	// are logged.
+	Warn func(*ParseError)
+}
+
+// Parse reads records from r and hands them to save one by one as genes
+// without genome ID.
+func (p FastaParser) Parse(r io.Reader, save func(Gene) error) error {
+	br := bufio.NewReader(r)
+	var gene Gene
+	var seq []rune
+	var headerLine int
+	lineNum := 0
+	finish := func() error {
+		if gene.Gene == "" {
+			return nil
+		}
+		res, err := p.checkSequence(seq, headerLine)
+		if err != nil || len(res) == 0 {
+			return err
+		}
+		gene.Seq = res
+		gene.SeqLen = len(res)
+		return save(gene)
+	}
+
+	for {
+		line, readErr := br.ReadString('\n')
+		if readErr != nil && readErr != io.EOF {
+			return &ParseError{File: p.Path, Line: lineNum + 1, Err: readErr}
+		}
+		if readErr == io.EOF && line == "" {
+			break
+		}
+		lineNum++
+		line = strings.TrimRight(line, "\r\n")
+		switch {
+		case strings.TrimSpace(line) == "":
+		case line[0] == '>':
+			if err := finish(); err != nil {
+				return err
+			}
+			h, err := ParseHeader(line)
+			if err != nil {
+				return &ParseError{File: p.Path, Line: lineNum, Err: err}
+			}
+			gene = Gene{Gene: h.ID, Desc: h.Desc, Locus: h.Locus,
+				Accession: h.Accession, Symbol: h.Symbol, Organism: h.Organism,
+				Biotype: h.Biotype, TaxonID: h.TaxonID}
+			seq = seq[:0]
+			headerLine = lineNum
+		case gene.Gene == "":
+			err := p.problem(lineNum, errors.New("sequence without a header"))
+			if err != nil {
+				return err
+			}
+		default:
+			for _, r := range line {
+				if r != ' ' && r != '\t' {
+					seq = append(seq, r)
+				}
+			}
+		}
+		if readErr == io.EOF {
+			break
+		}
+	}
+	return finish()
+}
+
+// checkSequence normalizes a sequence of a record that starts at line, and
+// validates its residues.
+func (p FastaParser) checkSequence(seq []rune, line int) ([]rune, error) {
+	res := make([]rune, 0, len(seq))
+	var invalid, stops int
+	for i, r := range seq {
+		if r >= 'a' && r <= 'z' {
+			r -= 'a' - 'A'
+		}
+		switch {
+		case r == '*' && i == len(seq)-1:
+			continue
+		case r == '*':
+			stops++
+		case !strings.ContainsRune(residues, r):
+			invalid++
+			r = 'X'
+		}
+		res = append(res, r)
+	}
+	if len(res) == 0 {
+		return nil, p.problem(line, errors.New("record has no sequence"))
+	}
+	if invalid > 0 {
+		err := p.problem(line, fmt.Errorf("sequence has %d invalid "+
+			"characters", invalid))
+		if err != nil {
+			return nil, err
+		}
+	}
+	if stops > 0 {
+		err := p.problem(line, fmt.Errorf("sequence has %d internal stop "+
+			"codons", stops))
+		if err != nil {
+			return nil, err
+		}
+	}
+	return res, nil
+}
+
+// problem returns an error in strict mode, and sends a warning otherwise.
+func (p FastaParser) problem(line int, err error) error {
+	pe := &ParseError{File: p.Path, Line: line, Err: err}
+	if p.Strict {
+		return pe
+	}
+	if p.Warn == nil {
+		log.Printf("Warning: %s", pe)
+	} else {
+		p.Warn(pe)
+	}
+	return nil
+}
@@ -0,0 +1,135 @@
+package smithwatr
+
+import (
+	"container/heap"
+	"math"
+	"sort"
+)
+
+// karlinAltschul keeps statistical parameters of BLOSUM62 scores.
+type karlinAltschul struct {
+	Lambda float64
+	K      float64
+}
+
+// blosum62Stats contains parameters for gap open and gap extension
+// penalties as published for NCBI BLAST. Other penalties fall back to
+// ungapped parameters, so E-values for them are only an estimate.
+var blosum62Stats = map[[2]int]karlinAltschul{
+	{11, 2}: {0.297, 0.082},
+	{10, 2}: {0.291, 0.075},
+	{9, 2}:  {0.279, 0.058},
+	{8, 2}:  {0.264, 0.045},
+	{7, 2}:  {0.239, 0.027},
+	{6, 2}:  {0.201, 0.012},
+	{13, 1}: {0.292, 0.071},
+	{12, 1}: {0.283, 0.059},
+	{11, 1}: {0.267, 0.041},
+	{10, 1}: {0.243, 0.024},
+	{9, 1}:  {0.206, 0.010},
+}
+
+var blosum62Ungapped = karlinAltschul{0.3176, 0.134}
+
+func statsFor(conf Env) karlinAltschul {
+	if ka, ok := blosum62Stats[[2]int{conf.GapOpens, conf.GapExtends}]; ok {
+		return ka
+	}
+	return blosum62Ungapped
+}
+
+// bitScore converts a raw score to bits.
+func (ka karlinAltschul) bitScore(score int) float64 {
+	return (ka.Lambda*float64(score) - math.Log(ka.K)) / math.Ln2
+}
+
+// evalue is the number of hits with at least the given score expected by
+// chance in a search of a query of queryLen against dbLen residues.
+func (ka karlinAltschul) evalue(score int, queryLen int, dbLen int) float64 {
+	return float64(queryLen) * float64(dbLen) *
+		math.Pow(2, -ka.bitScore(score))
+}
+
+// hitFilter drops alignments that do not pass score, identity and E-value
+// thresholds and, if topN is positive, keeps only topN best alignments
+// for every query gene.
+type hitFilter struct {
+	topN        int
+	minScore    int
+	minIdentity float32
+	maxEvalue   float64
+	dbLen       int
+	stats       karlinAltschul
+	best        map[int]*hitHeap
+}
+
+// newHitFilter creates a filter with the thresholds of conf. dbLen is the
+// number of residues in the target genome, it is used for E-values.
+func newHitFilter(conf Env, dbLen int) *hitFilter {
+	return &hitFilter{topN: conf.TopN, minScore: conf.MinScore,
+		minIdentity: conf.MinIdentity, maxEvalue: conf.MaxEvalue,
+		dbLen: dbLen, stats: statsFor(conf), best: make(map[int]*hitHeap)}
+}
+
+// add calculates statistics of an alignment and filters it. Alignments
+// that pass are returned at once when there is no topN limit. Otherwise
+// they wait in a heap of their query gene until flush is called.
+func (f *hitFilter) add(a Alignment) []Alignment {
+	a.BitScore = f.stats.bitScore(a.Score)
+	a.Evalue = f.stats.evalue(a.Score, a.Gene1.SeqLen, f.dbLen)
+	if a.Score < f.minScore {
+		return nil
+	}
+	if ident, _ := a.IdentitySimilarity(); ident < f.minIdentity {
+		return nil
+	}
+	if f.maxEvalue > 0 && a.Evalue > f.maxEvalue {
+		return nil
+	}
+	if f.topN < 1 {
+		return []Alignment{a}
+	}
+
+	h, ok := f.best[a.Gene1.ID]
+	if !ok {
+		h = &hitHeap{}
+		f.best[a.Gene1.ID] = h
+	}
+	if h.Len() < f.topN {
+		heap.Push(h, a)
+	} else if (*h)[0].Score < a.Score {
+		(*h)[0] = a
+		heap.Fix(h, 0)
+	}
+	return nil
+}
+
+// flush returns the best alignments of a query gene, after all its
+// alignments went through add.
+func (f *hitFilter) flush(geneID int) []Alignment {
+	h, ok := f.best[geneID]
+	if !ok {
+		return nil
+	}
+	delete(f.best, geneID)
+	res := []Alignment(*h)
+	sort.Slice(res, func(i, j int) bool { return res[i].Score > res[j].Score })
+	return res
+}
+
+// hitHeap is a min-heap of alignments by score, so the worst of the kept
+// alignments is always on top.
+type hitHeap []Alignment
+
+func (h hitHeap) Len() int            { return len(h) }
+func (h hitHeap) Less(i, j int) bool  { return h[i].Score < h[j].Score }
+func (h hitHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *hitHeap) Push(x interface{}) { *h = append(*h, x.(Alignment)) }
+
+func (h *hitHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	x := old[n-1]
+	*h = old[0 : n-1]
+	return x
+}
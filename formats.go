@@ -0,0 +1,463 @@
+package smithwatr
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// RecordParser reads genes from a file of one format and hands them to
+// save one by one.
+type RecordParser interface {
+	Parse(r io.Reader, save func(Gene) error) error
+}
+
+// UniprotXMLParser reads UniProt XML files. It has the same settings as
+// FastaParser, they apply to sequence validation.
+type UniprotXMLParser FastaParser
+
+// UniprotDatParser reads UniProt flat files (.dat). It has the same
+// settings as FastaParser.
+type UniprotDatParser FastaParser
+
+// GenbankParser reads GenPept flat files of proteins from GenBank and
+// RefSeq. It has the same settings as FastaParser.
+type GenbankParser FastaParser
+
+// newRecordParser detects the format of a file by its first characters,
+// and returns a parser for it. FASTA is the default. EMBL and GenBank
+// nucleotide files start like UniProt and GenPept flat files, they are
+// rejected, because nucleotides are valid amino acid letters.
+func newRecordParser(br *bufio.Reader, fp FastaParser) (RecordParser, error) {
+	head, _ := br.Peek(512)
+	head = bytes.TrimLeft(head, " \t\r\n")
+	switch {
+	case bytes.HasPrefix(head, []byte("<?xml")),
+		bytes.HasPrefix(head, []byte("<uniprot")):
+		return UniprotXMLParser(fp), nil
+	case bytes.HasPrefix(head, []byte("ID   ")):
+		if isEMBL(firstLine(head)) {
+			return nil, nucleotideError(fp, "EMBL")
+		}
+		return UniprotDatParser(fp), nil
+	case bytes.HasPrefix(head, []byte("LOCUS ")):
+		if isGenbankNucleotide(firstLine(head)) {
+			return nil, nucleotideError(fp, "GenBank")
+		}
+		return GenbankParser(fp), nil
+	default:
+		return fp, nil
+	}
+}
+
+// nucleotideError rejects a flat file of nucleotide sequences.
+func nucleotideError(fp FastaParser, format string) error {
+	return &ParseError{File: fp.Path, Line: 1,
+		Err: fmt.Errorf("%s nucleotide files are not supported, "+
+			"use protein sequences", format)}
+}
+
+// firstLine returns the first line of head without the line end.
+func firstLine(head []byte) []byte {
+	if i := bytes.IndexByte(head, '\n'); i >= 0 {
+		head = head[:i]
+	}
+	return bytes.TrimRight(head, " \r")
+}
+
+// isEMBL tells if the ID line of a flat file is from EMBL. Its sequence
+// length is in base pairs, and it often has a sequence version, like
+// 'ID   X56734; SV 1; linear; mRNA; STD; PLN; 1859 BP.'
+func isEMBL(id []byte) bool {
+	return bytes.HasSuffix(id, []byte(" BP.")) ||
+		bytes.Contains(id, []byte("; SV "))
+}
+
+// isGenbankNucleotide tells if the LOCUS line of a flat file describes a
+// nucleotide sequence. Its length is in base pairs and a molecule type
+// follows, like 'LOCUS       X56734   1859 bp    mRNA    linear   PLN'.
+func isGenbankNucleotide(locus []byte) bool {
+	fields := strings.Fields(string(locus))
+	for i := 0; i+1 < len(fields); i++ {
+		if fields[i] == "bp" {
+			mol := strings.ToUpper(fields[i+1])
+			return strings.HasSuffix(mol, "DNA") ||
+				strings.HasSuffix(mol, "RNA")
+		}
+	}
+	return false
+}
+
+// uniprotEntry is an 'entry' element of UniProt XML.
+type uniprotEntry struct {
+	Dataset    string   `xml:"dataset,attr"`
+	Accessions []string `xml:"accession"`
+	Name       string   `xml:"name"`
+	FullName   string   `xml:"protein>recommendedName>fullName"`
+	SubName    string   `xml:"protein>submittedName>fullName"`
+	Genes      []struct {
+		Type string `xml:"type,attr"`
+		Name string `xml:",chardata"`
+	} `xml:"gene>name"`
+	Organism struct {
+		Names []struct {
+			Type string `xml:"type,attr"`
+			Name string `xml:",chardata"`
+		} `xml:"name"`
+		Refs []struct {
+			Type string `xml:"type,attr"`
+			ID   string `xml:"id,attr"`
+		} `xml:"dbReference"`
+	} `xml:"organism"`
+	Refs []struct {
+		Type string `xml:"type,attr"`
+		ID   string `xml:"id,attr"`
+	} `xml:"dbReference"`
+	Keywords []string `xml:"keyword"`
+	Sequence string   `xml:"sequence"`
+}
+
+// Parse reads 'entry' elements of UniProt XML one by one, so the whole
+// file is never kept in memory.
+func (p UniprotXMLParser) Parse(r io.Reader, save func(Gene) error) error {
+	dec := xml.NewDecoder(r)
+	for {
+		t, err := dec.Token()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return &ParseError{File: p.Path, Err: err}
+		}
+		se, ok := t.(xml.StartElement)
+		if !ok || se.Name.Local != "entry" {
+			continue
+		}
+		var e uniprotEntry
+		if err = dec.DecodeElement(&e, &se); err != nil {
+			return &ParseError{File: p.Path, Err: err}
+		}
+		if len(e.Accessions) == 0 {
+			return &ParseError{File: p.Path,
+				Err: fmt.Errorf("entry %s has no accession", e.Name)}
+		}
+		g := e.gene()
+		ok, err = setSequence(FastaParser(p), &g, e.Sequence, 0)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+		if err = save(g); err != nil {
+			return err
+		}
+	}
+}
+
+func (e uniprotEntry) gene() Gene {
+	db := "tr"
+	if e.Dataset == "Swiss-Prot" {
+		db = "sp"
+	}
+	acc := e.Accessions[0]
+	g := Gene{Gene: db + "|" + acc + "|" + e.Name, Accession: acc,
+		Locus: acc, Desc: e.FullName, Biotype: "protein_coding",
+		Keywords: e.Keywords}
+	if g.Desc == "" {
+		g.Desc = e.SubName
+	}
+	for _, n := range e.Genes {
+		if n.Type == "primary" || g.Symbol == "" {
+			g.Symbol = n.Name
+		}
+	}
+	for _, n := range e.Organism.Names {
+		if n.Type == "scientific" {
+			g.Organism = n.Name
+		}
+	}
+	for _, ref := range e.Organism.Refs {
+		if ref.Type == "NCBI Taxonomy" {
+			g.TaxonID, _ = strconv.Atoi(ref.ID)
+		}
+	}
+	for _, ref := range e.Refs {
+		if ref.Type == "GO" {
+			g.GO = append(g.GO, ref.ID)
+		}
+	}
+	return g
+}
+
+// flatRecord is a record of a flat file being read.
+type flatRecord struct {
+	Gene
+	seq []string
+	// db is 'sp' for reviewed UniProt entries, and 'tr' for others.
+	db string
+	// last is the code of the last line that had one, lines without codes
+	// continue it.
+	last string
+}
+
+// flatField splits a line of a flat file into a code of the given width
+// and a value.
+func flatField(l string, width int) (string, string) {
+	if len(l) <= width {
+		return strings.TrimSpace(l), ""
+	}
+	return strings.TrimSpace(l[:width]), strings.TrimSpace(l[width:])
+}
+
+// splitList splits values like 'Acetylation; Heme; Iron.'
+func splitList(val string) []string {
+	var res []string
+	for _, v := range strings.Split(strings.TrimRight(val, "."), ";") {
+		if v = strings.TrimSpace(v); v != "" {
+			res = append(res, v)
+		}
+	}
+	return res
+}
+
+// Parse reads records of a UniProt flat file. Every line starts with a
+// two letter code, sequence lines are indented, records end with '//'.
+func (p UniprotDatParser) Parse(r io.Reader, save func(Gene) error) error {
+	return parseFlatFile(FastaParser(p), r, save, uniprotDatLine)
+}
+
+// uniprotDatLine adds data of one line of a UniProt flat file to a record.
+// It returns an error if a required value is missing.
+func uniprotDatLine(rec *flatRecord, l string) error {
+	code, val := flatField(l, 5)
+	switch code {
+	case "ID":
+		fields := strings.Fields(val)
+		if len(fields) == 0 {
+			return fmt.Errorf("ID line has no entry name")
+		}
+		rec.Gene.Gene = fields[0]
+		rec.Biotype = "protein_coding"
+		rec.db = "tr"
+		if strings.Contains(val, " Reviewed;") {
+			rec.db = "sp"
+		}
+	case "AC":
+		if rec.Accession == "" {
+			acc := splitList(val)
+			if len(acc) == 0 {
+				return fmt.Errorf("AC line has no accession")
+			}
+			rec.Accession = acc[0]
+			rec.Locus = rec.Accession
+			rec.Gene.Gene = rec.db + "|" + rec.Accession + "|" + rec.Gene.Gene
+		}
+	case "DE":
+		for _, prefix := range []string{"RecName: Full=", "SubName: Full="} {
+			if rec.Desc == "" && strings.HasPrefix(val, prefix) {
+				rec.Desc = withoutEvidence(val[len(prefix):])
+			}
+		}
+	case "GN":
+		if rec.Symbol == "" && strings.HasPrefix(val, "Name=") {
+			rec.Symbol = withoutEvidence(val[len("Name="):])
+		}
+	case "OS":
+		if rec.Organism == "" {
+			rec.Organism = strings.TrimRight(val, ".")
+			if i := strings.Index(rec.Organism, " ("); i >= 0 {
+				rec.Organism = rec.Organism[:i]
+			}
+		}
+	case "OX":
+		if strings.HasPrefix(val, "NCBI_TaxID=") {
+			id := withoutEvidence(val[len("NCBI_TaxID="):])
+			rec.TaxonID, _ = strconv.Atoi(id)
+		}
+	case "DR":
+		if ref := splitList(val); len(ref) > 1 && ref[0] == "GO" {
+			rec.GO = append(rec.GO, ref[1])
+		}
+	case "KW":
+		rec.Keywords = append(rec.Keywords, splitList(val)...)
+	case "":
+		rec.seq = append(rec.seq, val)
+	}
+	return nil
+}
+
+// withoutEvidence cuts a value of a UniProt field at ';', and removes
+// evidence codes like '{ECO:0000313}'.
+func withoutEvidence(val string) string {
+	if i := strings.Index(val, ";"); i >= 0 {
+		val = val[:i]
+	}
+	if i := strings.Index(val, " {"); i >= 0 {
+		val = val[:i]
+	}
+	return strings.TrimSpace(val)
+}
+
+// Parse reads records of a GenPept flat file. Keywords start at the first
+// column, records end with '//'.
+func (p GenbankParser) Parse(r io.Reader, save func(Gene) error) error {
+	return parseFlatFile(FastaParser(p), r, save, genbankLine)
+}
+
+// genbankLine adds data of one line of a GenPept flat file to a record.
+// Feature qualifiers and continuation lines have no code, the sequence
+// follows ORIGIN. It returns an error if a required value is missing.
+func genbankLine(rec *flatRecord, l string) error {
+	if rec.last == "ORIGIN" {
+		rec.seq = append(rec.seq, l)
+		return nil
+	}
+	code, val := flatField(l, 12)
+	if code == "" {
+		switch rec.last {
+		case "DEFINITION":
+			rec.Desc += " " + val
+		case "KEYWORDS":
+			rec.Keywords = append(rec.Keywords, splitList(val)...)
+		case "FEATURES":
+			genbankQualifier(rec, val)
+		}
+		return nil
+	}
+	if strings.HasPrefix(l, " ") && rec.last == "FEATURES" {
+		// feature names are indented, qualifiers follow them
+		return nil
+	}
+	if rec.last == "DEFINITION" {
+		// remove organism and the final dot
+		rec.Desc = strings.TrimRight(rec.Desc, ".")
+		if i := strings.LastIndex(rec.Desc, " ["); i >= 0 {
+			rec.Desc = rec.Desc[:i]
+		}
+	}
+	rec.last = code
+	switch code {
+	case "LOCUS":
+		rec.Biotype = "protein_coding"
+	case "DEFINITION":
+		rec.Desc = val
+	case "VERSION":
+		fields := strings.Fields(val)
+		if len(fields) == 0 {
+			return fmt.Errorf("VERSION line has no accession")
+		}
+		rec.Accession = fields[0]
+		rec.Gene.Gene = rec.Accession
+		rec.Locus = rec.Accession
+	case "KEYWORDS":
+		rec.Keywords = splitList(val)
+	case "ORGANISM":
+		rec.Organism = val
+	}
+	return nil
+}
+
+// genbankQualifier reads feature qualifiers like /gene="HBB".
+func genbankQualifier(rec *flatRecord, val string) {
+	kv := strings.SplitN(strings.TrimPrefix(val, "/"), "=", 2)
+	if !strings.HasPrefix(val, "/") || len(kv) < 2 {
+		return
+	}
+	v := strings.Trim(kv[1], `"`)
+	switch kv[0] {
+	case "gene":
+		if rec.Symbol == "" {
+			rec.Symbol = v
+		}
+	case "organism":
+		if rec.Organism == "" {
+			rec.Organism = v
+		}
+	case "db_xref":
+		switch {
+		case strings.HasPrefix(v, "taxon:"):
+			rec.TaxonID, _ = strconv.Atoi(v[len("taxon:"):])
+		case strings.HasPrefix(v, "GO:"):
+			rec.GO = append(rec.GO, v)
+		}
+	}
+}
+
+// parseFlatFile reads records of flat files line by line with the line
+// function of a format. Records end with '//'. Errors of the line function
+// are problems of the parser, in lenient mode such lines are skipped.
+func parseFlatFile(p FastaParser, r io.Reader, save func(Gene) error,
+	line func(*flatRecord, string) error) error {
+	br := bufio.NewReader(r)
+	var rec flatRecord
+	start, lineNum := 0, 0
+	for {
+		l, readErr := br.ReadString('\n')
+		if readErr != nil && readErr != io.EOF {
+			return &ParseError{File: p.Path, Line: lineNum + 1, Err: readErr}
+		}
+		if readErr == io.EOF && l == "" {
+			break
+		}
+		lineNum++
+		l = strings.TrimRight(l, "\r\n")
+		switch {
+		case strings.HasPrefix(l, "//"):
+			g := rec.Gene
+			ok, err := setSequence(p, &g, strings.Join(rec.seq, ""), start)
+			if err != nil {
+				return err
+			}
+			if ok {
+				if err = save(g); err != nil {
+					return err
+				}
+			}
+			rec, start = flatRecord{}, 0
+		case strings.TrimSpace(l) != "":
+			if start == 0 {
+				start = lineNum
+			}
+			if err := line(&rec, l); err != nil {
+				if err = p.problem(lineNum, err); err != nil {
+					return err
+				}
+			}
+		}
+		if readErr == io.EOF {
+			break
+		}
+	}
+	if start != 0 {
+		return &ParseError{File: p.Path, Line: start,
+			Err: fmt.Errorf("record %s has no end", rec.Gene.Gene)}
+	}
+	return nil
+}
+
+// setSequence removes spaces and position numbers from a sequence,
+// validates it with the rules of FASTA files, and sets it to a gene.
+func setSequence(p FastaParser, g *Gene, seq string, line int) (bool, error) {
+	var res []rune
+	for _, r := range seq {
+		if !unicode.IsSpace(r) && !unicode.IsDigit(r) {
+			res = append(res, r)
+		}
+	}
+	if g.Gene == "" {
+		return false, p.problem(line, fmt.Errorf("record has no name"))
+	}
+	res, err := p.checkSequence(res, line)
+	if err != nil || len(res) == 0 {
+		return false, err
+	}
+	g.Seq = res
+	g.SeqLen = len(res)
+	return true, nil
+}
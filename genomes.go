@@ -0,0 +1,230 @@
+package smithwatr
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Genome is a proteome registered for import. FileName is either an
+// absolute path, or a path relative to DATA_DIR.
+type Genome struct {
+	ID           int
+	FileName     string
+	Species      string
+	SpeciesShort string
+	TaxonID      int
+	// GenesNum is the number of imported genes of the genome.
+	GenesNum int
+}
+
+// AddGenome registers a genome. If a genome with the same file name
+// exists already, its names and taxon ID are updated.
+func AddGenome(db *sql.DB, g Genome) (Genome, error) {
+	q := `INSERT INTO genomes (file_name, species, species_short, taxon_id)
+	        VALUES ($1, $2, $3, $4)
+	        ON CONFLICT (file_name) DO UPDATE
+	          SET species = EXCLUDED.species,
+	              species_short = EXCLUDED.species_short,
+	              taxon_id = EXCLUDED.taxon_id
+	        RETURNING id`
+	err := db.QueryRow(q, g.FileName, g.Species, g.SpeciesShort,
+		g.TaxonID).Scan(&g.ID)
+	return g, dbError("register genome "+g.FileName, err)
+}
+
+// SetGenomeFile changes the file of a genome, so the next import reads
+// the new file.
+func SetGenomeFile(db *sql.DB, id int, file string) error {
+	q := "UPDATE genomes SET file_name = $2 WHERE id = $1"
+	res, err := db.Exec(q, id, file)
+	if err != nil {
+		return dbError(fmt.Sprintf("change file of genome %d", id), err)
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return fmt.Errorf("Genome %d does not exist", id)
+	}
+	return nil
+}
+
+// GetGenomeInfo returns a registered genome by its ID.
+func GetGenomeInfo(db *sql.DB, id int) (Genome, error) {
+	g := Genome{ID: id}
+	q := `SELECT file_name, species, species_short, taxon_id,
+	             (SELECT count(*) FROM genes WHERE genome_id = $1)
+	        FROM genomes
+	        WHERE id = $1`
+	err := db.QueryRow(q, id).Scan(&g.FileName, &g.Species, &g.SpeciesShort,
+		&g.TaxonID, &g.GenesNum)
+	return g, dbError(fmt.Sprintf("find genome %d", id), err)
+}
+
+// ListGenomes returns all registered genomes with the number of their
+// imported genes.
+func ListGenomes(db *sql.DB) ([]Genome, error) {
+	var res []Genome
+	q := `SELECT g.id, g.file_name, g.species, g.species_short, g.taxon_id,
+	             count(n.id)
+	        FROM genomes g
+	          LEFT OUTER JOIN genes n ON n.genome_id = g.id
+	        GROUP BY g.id
+	        ORDER BY g.id`
+	rows, err := db.Query(q)
+	if err != nil {
+		return nil, dbError("list genomes", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var g Genome
+		err := rows.Scan(&g.ID, &g.FileName, &g.Species, &g.SpeciesShort,
+			&g.TaxonID, &g.GenesNum)
+		if err != nil {
+			return nil, dbError("list genomes", err)
+		}
+		res = append(res, g)
+	}
+	return res, dbError("list genomes", rows.Err())
+}
+
+// RemoveGenome deletes a genome with its genes and import history, and all
+// runs, jobs, alignments and orthologs that involve the genome.
+func RemoveGenome(db *sql.DB, id int) (err error) {
+	transaction, err := db.Begin()
+	if err != nil {
+		return dbError("start a transaction", err)
+	}
+	defer func() {
+		if err != nil {
+			transaction.Rollback()
+		}
+	}()
+
+	runs := `SELECT id FROM runs
+	           WHERE query_genome_id = $1 OR target_genome_id = $1`
+	qs := []string{
+		"DELETE FROM genes_matches WHERE run_id IN (" + runs + ")",
+		"DELETE FROM jobs WHERE run_id IN (" + runs + ")",
+		"DELETE FROM orthologs WHERE run_id IN (" + runs + ")" +
+			" OR reverse_run_id IN (" + runs + ")",
+		`DELETE FROM cluster_members WHERE gene_id IN
+		   (SELECT id FROM genes WHERE genome_id = $1)`,
+		"DELETE FROM runs WHERE query_genome_id = $1 OR target_genome_id = $1",
+		"DELETE FROM genes WHERE genome_id = $1",
+		"DELETE FROM imports WHERE genome_id = $1",
+		"DELETE FROM genomes WHERE id = $1",
+	}
+	for _, q := range qs {
+		if _, err = transaction.Exec(q, id); err != nil {
+			return dbError(fmt.Sprintf("remove genome %d", id), err)
+		}
+	}
+	err = transaction.Commit()
+	return dbError(fmt.Sprintf("remove genome %d", id), err)
+}
+
+// ImportReport records an import of a genome file: its checksum, and how
+// many genes were added, removed, changed or left as they were.
+type ImportReport struct {
+	ID        int
+	GenomeID  int
+	FileName  string
+	Checksum  string
+	Size      int64
+	Added     int
+	Removed   int
+	Changed   int
+	Unchanged int
+	// Skipped is true when the file was imported before with the same
+	// checksum, and nothing was done.
+	Skipped    bool
+	ImportedAt time.Time
+}
+
+// ImportGenome imports genes of a registered genome from its file. If the
+// file was imported already with the same checksum, it is skipped.
+// Otherwise genes are compared with the previous version of the genome,
+// and only the differences are saved.
+func ImportGenome(db *sql.DB, conf Env, g Genome) (ImportReport, error) {
+	rep := ImportReport{GenomeID: g.ID, FileName: g.FileName}
+	if !filepath.IsAbs(rep.FileName) {
+		rep.FileName = filepath.Join(conf.DataDir, rep.FileName)
+	}
+	var err error
+	rep.Checksum, rep.Size, err = fileChecksum(rep.FileName)
+	if err != nil {
+		return rep, err
+	}
+	var last string
+	q := `SELECT checksum FROM imports
+	        WHERE genome_id = $1
+	        ORDER BY id DESC LIMIT 1`
+	err = db.QueryRow(q, g.ID).Scan(&last)
+	if err != nil && err != sql.ErrNoRows {
+		return rep, dbError("find last import", err)
+	}
+	if last == rep.Checksum {
+		rep.Skipped = true
+		return rep, nil
+	}
+	log.Printf("Importing genome %d from %s", g.ID, rep.FileName)
+	return processFile(db, conf, rep)
+}
+
+// ImportHistory returns all imports of a genome, the oldest first.
+func ImportHistory(db *sql.DB, genomeID int) ([]ImportReport, error) {
+	var res []ImportReport
+	q := `SELECT id, file_name, checksum, size, added, removed, changed,
+	             unchanged, imported_at
+	        FROM imports
+	        WHERE genome_id = $1
+	        ORDER BY id`
+	rows, err := db.Query(q, genomeID)
+	if err != nil {
+		return nil, dbError("read import history", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		rep := ImportReport{GenomeID: genomeID}
+		err := rows.Scan(&rep.ID, &rep.FileName, &rep.Checksum, &rep.Size,
+			&rep.Added, &rep.Removed, &rep.Changed, &rep.Unchanged,
+			&rep.ImportedAt)
+		if err != nil {
+			return nil, dbError("read import history", err)
+		}
+		res = append(res, rep)
+	}
+	return res, dbError("read import history", rows.Err())
+}
+
+func saveImport(transaction *sql.Tx, rep *ImportReport) error {
+	q := `INSERT INTO imports (genome_id, file_name, checksum, size, added,
+	                           removed, changed, unchanged)
+	        VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+	        RETURNING id, imported_at`
+	err := transaction.QueryRow(q, rep.GenomeID, rep.FileName, rep.Checksum,
+		rep.Size, rep.Added, rep.Removed, rep.Changed,
+		rep.Unchanged).Scan(&rep.ID, &rep.ImportedAt)
+	return dbError("record import", err)
+}
+
+// fileChecksum returns SHA-256 checksum of a file as it is on disk, and
+// its size.
+func fileChecksum(path string) (string, int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", 0, err
+	}
+	defer f.Close()
+	h := sha256.New()
+	size, err := io.Copy(h, f)
+	if err != nil {
+		return "", 0, err
+	}
+	return hex.EncodeToString(h.Sum(nil)), size, nil
+}
@@ -0,0 +1,206 @@
+package smithwatr
+
+import (
+	"errors"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Header contains data about a protein found in its FASTA header.
+type Header struct {
+	// ID is the first word of the header, it is used as a name of a gene.
+	ID        string
+	Accession string
+	Symbol    string
+	Organism  string
+	Biotype   string
+	TaxonID   int
+	// Locus is the gene a protein isoform belongs to.
+	Locus string
+	Desc  string
+}
+
+// HeaderParser reads headers of one source of FASTA files. Match decides
+// if a header comes from the source, Parse extracts data from it.
+type HeaderParser struct {
+	Name  string
+	Match func(header string) bool
+	Parse func(header string) (Header, error)
+}
+
+// headerParsers are tried in order, the first matching parser is used.
+// Headers that no parser matches are read by parseGenericHeader.
+var headerParsers = []HeaderParser{
+	{Name: "uniprot", Match: uniprotHeader.MatchString,
+		Parse: parseUniprotHeader},
+	{Name: "ensembl", Match: ensemblHeader.MatchString,
+		Parse: parseEnsemblHeader},
+	{Name: "araport", Match: araportHeader.MatchString,
+		Parse: parseAraportHeader},
+	{Name: "refseq", Match: refseqHeader.MatchString,
+		Parse: parseRefseqHeader},
+}
+
+var (
+	uniprotHeader = regexp.MustCompile(`^(sp|tr)\|[^|]+\|\S+`)
+	ensemblHeader = regexp.MustCompile(`^\S+ pep\b.* gene:\S+`)
+	araportHeader = regexp.MustCompile(`^AT[1-5CM]G\d{5}\.\d+ \|`)
+	refseqHeader  = regexp.MustCompile(
+		`^(gi\|\d+\|ref\|)?[NXWY]P_\d+(\.\d+)?\|?\s`)
+
+	// araportID matches Araport protein names, where the isoform number
+	// follows the locus, like AT1G01010.1.
+	araportID = regexp.MustCompile(`^(AT[1-5CM]G\d{5})\.\d+$`)
+	// uniprotField matches the start of 'KEY=value' fields of UniProt.
+	uniprotField = regexp.MustCompile(`\s([A-Z]{2})=`)
+)
+
+// RegisterHeaderParser adds a parser for a new source of FASTA files. It is
+// tried before the parsers that are already registered.
+func RegisterHeaderParser(p HeaderParser) {
+	headerParsers = append([]HeaderParser{p}, headerParsers...)
+}
+
+// ParseHeader reads a FASTA header line with the first registered parser
+// that matches it. Locus defaults to the ID of the header.
+func ParseHeader(line string) (Header, error) {
+	line = strings.TrimSpace(strings.TrimPrefix(line, ">"))
+	if line == "" {
+		return Header{}, errors.New("header is empty")
+	}
+	parse := parseGenericHeader
+	for _, p := range headerParsers {
+		if p.Match(line) {
+			parse = p.Parse
+			break
+		}
+	}
+	h, err := parse(line)
+	if err == nil && h.Locus == "" {
+		h.Locus = h.ID
+	}
+	return h, err
+}
+
+// parseGenericHeader takes the first word of a header as ID and the rest
+// as description, which can be missing.
+func parseGenericHeader(line string) (Header, error) {
+	fields := strings.SplitN(line, " ", 2)
+	h := Header{ID: fields[0], Accession: fields[0]}
+	if len(fields) > 1 {
+		h.Desc = strings.TrimSpace(fields[1])
+	}
+	return h, nil
+}
+
+// parseEnsemblHeader reads 'key:value' fields of Ensembl headers, like
+// 'ENSP00000451042.1 pep chromosome:GRCh38:14:... gene:ENSG00000228985.1
+// gene_biotype:TR_D_gene gene_symbol:TRDD3 description:T cell receptor'.
+// Description is the last field and can contain spaces.
+func parseEnsemblHeader(line string) (Header, error) {
+	h, _ := parseGenericHeader(line)
+	rest := h.Desc
+	h.Desc = ""
+	if i := strings.Index(rest, "description:"); i >= 0 {
+		h.Desc = strings.TrimSpace(rest[i+len("description:"):])
+		rest = rest[:i]
+	}
+	for _, f := range strings.Fields(rest) {
+		kv := strings.SplitN(f, ":", 2)
+		if len(kv) < 2 {
+			continue
+		}
+		switch kv[0] {
+		case "gene":
+			h.Locus = kv[1]
+		case "gene_symbol":
+			h.Symbol = kv[1]
+		case "transcript_biotype":
+			h.Biotype = kv[1]
+		case "gene_biotype":
+			if h.Biotype == "" {
+				h.Biotype = kv[1]
+			}
+		}
+	}
+	return h, nil
+}
+
+// parseUniprotHeader reads UniProt headers, like 'sp|P69905|HBA_HUMAN
+// Hemoglobin subunit alpha OS=Homo sapiens OX=9606 GN=HBA1 PE=1 SV=2'.
+// Isoforms, like P69905-2, belong to the locus of their main accession.
+func parseUniprotHeader(line string) (Header, error) {
+	h, _ := parseGenericHeader(line)
+	ids := strings.Split(h.ID, "|")
+	h.Accession = ids[1]
+	h.Locus = strings.SplitN(h.Accession, "-", 2)[0]
+	h.Biotype = "protein_coding"
+
+	locs := uniprotField.FindAllStringSubmatchIndex(" "+h.Desc, -1)
+	if len(locs) == 0 {
+		return h, nil
+	}
+	fields := " " + h.Desc
+	h.Desc = strings.TrimSpace(fields[:locs[0][0]])
+	for i, loc := range locs {
+		end := len(fields)
+		if i+1 < len(locs) {
+			end = locs[i+1][0]
+		}
+		val := strings.TrimSpace(fields[loc[1]:end])
+		switch fields[loc[2]:loc[3]] {
+		case "OS":
+			h.Organism = val
+		case "GN":
+			h.Symbol = val
+		case "OX":
+			h.TaxonID, _ = strconv.Atoi(val)
+		}
+	}
+	return h, nil
+}
+
+// parseAraportHeader reads pipe-delimited Araport headers, like
+// 'AT1G01020.1 | Symbols: ARV1 | ARV1 family protein | Chr1:6788-9130
+// REVERSE LENGTH=245'.
+func parseAraportHeader(line string) (Header, error) {
+	fields := strings.Split(line, "|")
+	for i := range fields {
+		fields[i] = strings.TrimSpace(fields[i])
+	}
+	h := Header{ID: fields[0], Accession: fields[0],
+		Organism: "Arabidopsis thaliana", Biotype: "protein_coding"}
+	if m := araportID.FindStringSubmatch(h.ID); m != nil {
+		h.Locus = m[1]
+	}
+	fields = fields[1:]
+	if len(fields) > 0 && strings.HasPrefix(fields[0], "Symbols:") {
+		symbols := strings.Split(strings.TrimPrefix(fields[0], "Symbols:"), ",")
+		h.Symbol = strings.TrimSpace(symbols[0])
+		fields = fields[1:]
+	}
+	if len(fields) > 0 {
+		h.Desc = fields[0]
+	}
+	return h, nil
+}
+
+// parseRefseqHeader reads NCBI RefSeq headers, like 'NP_000509.1
+// hemoglobin subunit beta [Homo sapiens]', also in the older form with a
+// 'gi|4504349|ref|NP_000509.1|' prefix.
+func parseRefseqHeader(line string) (Header, error) {
+	h, _ := parseGenericHeader(line)
+	if strings.HasPrefix(h.ID, "gi|") {
+		h.Accession = strings.Split(h.ID, "|")[3]
+	}
+	h.Locus = h.Accession
+	h.Biotype = "protein_coding"
+	if strings.HasSuffix(h.Desc, "]") {
+		if i := strings.LastIndex(h.Desc, "["); i >= 0 {
+			h.Organism = h.Desc[i+1 : len(h.Desc)-1]
+			h.Desc = strings.TrimSpace(h.Desc[:i])
+		}
+	}
+	return h, nil
+}
@@ -2,17 +2,18 @@ package smithwatr
 
 import (
 	"bufio"
-	"compress/gzip"
+	"crypto/md5"
 	"database/sql"
 	"fmt"
 	"log"
 	"os"
-	"path/filepath"
-	"strings"
 
 	"github.com/lib/pq"
 )
 
+// importBatchSize is the number of genes copied to the database at once.
+const importBatchSize = 1000
+
 type Gene struct {
 	ID       int
 	GenomeID int
@@ -20,128 +21,349 @@ type Gene struct {
 	Desc     string
 	Seq      []rune
 	SeqLen   int
+	// Locus is the gene a protein isoform belongs to.
+	Locus string
+	// Longest is true for the longest isoform of a locus.
+	Longest   bool
+	Accession string
+	Symbol    string
+	Organism  string
+	Biotype   string
+	TaxonID   int
+	Keywords  []string
+	// GO contains Gene Ontology terms, like GO:0005833.
+	GO []string
 }
 
-func ImportData(db *sql.DB, conf Env) {
-	if NotEmpty(db, "genes") {
-		return
+// ImportData imports genes of all registered genomes whose files are new
+// or changed since their last import. Files in DATA_DIR that are not
+// registered are ignored. Registered genomes without a file are skipped
+// with a warning, their genes stay as they were last imported.
+func ImportData(db *sql.DB, conf Env) error {
+	genomes, err := ListGenomes(db)
+	if err != nil {
+		return err
 	}
-
-	d, err := os.Open(conf.DataDir)
-	Check(err)
-	defer func() {
-		err := d.Close()
-		Check(err)
-	}()
-
-	names, err := d.Readdirnames(-1)
-	Check(err)
-	for _, name := range names {
-		l := len(name)
-		if name[l-3:l] == ".gz" {
-			genomeID := getGenomeID(db, name)
-			path := filepath.Join(conf.DataDir, name)
-			processFile(db, path, genomeID)
+	for _, g := range genomes {
+		rep, err := ImportGenome(db, conf, g)
+		if os.IsNotExist(err) {
+			log.Printf("Warning: file %s of genome %d is missing, skipping it",
+				rep.FileName, g.ID)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if !rep.Skipped {
+			log.Printf("Genome %d: %d genes added, %d removed, %d changed",
+				g.ID, rep.Added, rep.Removed, rep.Changed)
 		}
 	}
+	return nil
 }
 
-func ImportJobs(db *sql.DB, genomeID int) {
-	if NotEmpty(db, "jobs") {
-		return
-	}
-
-	q := "INSERT INTO jobs (gene_id) (SELECT id FROM genes WHERE genome_id = $1)"
-	db.QueryRow(q, genomeID)
+// ImportJobs creates a job for every gene of the query genome of a run, or
+// only for the longest isoforms if the run is restricted to them. Jobs that
+// already exist are kept as they are, so a run can be resumed. Jobs keep
+// the length of their sequence, longer ones are claimed first.
+func ImportJobs(db *sql.DB, run Run) error {
+	q := `INSERT INTO jobs (run_id, gene_id, seq_len)
+	        (SELECT $1, id, length(sequence) FROM genes
+	           WHERE genome_id = $2 AND (longest OR NOT $3))
+	        ON CONFLICT (run_id, gene_id) DO NOTHING`
+	_, err := db.Exec(q, run.ID, run.QueryGenomeID, run.LongestIsoform)
+	return dbError("create jobs", err)
 }
 
-func NotEmpty(db *sql.DB, t string) bool {
+// NotEmpty checks if a table has any rows.
+func NotEmpty(db *sql.DB, t string) (bool, error) {
 	var exists bool
 	q := "SELECT EXISTS(SELECT * FROM %s) AS has_rows"
 	err := db.QueryRow(fmt.Sprintf(q, t)).Scan(&exists)
-	Check(err)
-	return exists
+	return exists, dbError("check table "+t, err)
 }
 
-func getGenomeID(db *sql.DB, name string) int {
-	var id int
-	q := `SELECT id FROM genomes
-	        WHERE file_name = $1`
-	err := db.QueryRow(q, &name).Scan(&id)
-	Check(err)
-	return (id)
+// knownGene is a gene that was imported before, with an MD5 checksum of
+// its sequence.
+type knownGene struct {
+	id  int
+	md5 string
 }
 
-func processFile(db *sql.DB, path string, genomeID int) {
-	f, err := os.Open(path)
-	Check(err)
-	gz, err := gzip.NewReader(f)
-	Check(err)
-	scanner := bufio.NewScanner(gz)
-	genes := collectGenes(scanner, genomeID)
-	saveGenes(db, genes)
-}
+// processFile streams genes of a file to the database in batches of
+// importBatchSize, so memory use does not depend on the size of the file.
+// FASTA, UniProt XML and flat files, and GenPept files are supported.
+// All batches are saved in one transaction, and a file is imported
+// completely or not at all. With conf.StrictFasta any problem in the file
+// stops the import, otherwise problems are logged as warnings.
+//
+// If the genome has genes already, they are compared with the file by
+// name. New genes are added, genes that are not in the file any more are
+// removed, and genes with a different sequence are updated. Results that
+// depend on removed or updated genes are deleted, and their jobs are
+// queued again.
+//
+// rep has to contain the genome ID, the path and the checksum of the file.
+// The import is recorded with the numbers of added, removed and changed
+// genes.
+func processFile(db *sql.DB, conf Env,
+	rep ImportReport) (_ ImportReport, err error) {
+	genomeID, path := rep.GenomeID, rep.FileName
+	known, err := knownGenes(db, genomeID)
+	if err != nil {
+		return rep, err
+	}
+	r, err := openSequenceFile(path)
+	if err != nil {
+		return rep, err
+	}
+	defer r.Close()
 
-func collectGenes(scanner *bufio.Scanner, genomeID int) []Gene {
-	gene := Gene{}
-	var seq []string
-	res := []Gene{}
-	for scanner.Scan() {
-		line := scanner.Text()
-		if line[0] == '>' {
-			if gene.Gene != "" {
-				gene.Seq = []rune(joinSequence(seq))
-				res = append(res, gene)
+	transaction, err := db.Begin()
+	if err != nil {
+		return rep, dbError("start a transaction", err)
+	}
+	defer func() {
+		if err != nil {
+			transaction.Rollback()
+		}
+	}()
+
+	var changed []int
+	seen := make(map[string]struct{})
+	batch := make([]Gene, 0, importBatchSize)
+	br := bufio.NewReader(r)
+	rp, err := newRecordParser(br, FastaParser{Path: path,
+		Strict: conf.StrictFasta})
+	if err != nil {
+		return rep, err
+	}
+	err = rp.Parse(br, func(g Gene) error {
+		if _, ok := seen[g.Gene]; ok {
+			log.Printf("Warning: %s has a duplicate gene %s, skipping it",
+				path, g.Gene)
+			return nil
+		}
+		seen[g.Gene] = struct{}{}
+		g.GenomeID = genomeID
+		if k, ok := known[g.Gene]; ok {
+			delete(known, g.Gene)
+			if k.md5 == sequenceMD5(g.Seq) {
+				rep.Unchanged++
+				return nil
 			}
-			geneName, description := parseGeneHeader(line)
-			gene = Gene{GenomeID: genomeID, Gene: geneName, Desc: description}
-			seq = []string{}
-		} else {
-			seq = append(seq, strings.Trim(line, "\n\r"))
+			g.ID = k.id
+			changed = append(changed, g.ID)
+			return updateGene(transaction, g)
+		}
+		rep.Added++
+		batch = append(batch, g)
+		if len(batch) < importBatchSize {
+			return nil
+		}
+		err := saveGenes(transaction, batch)
+		batch = batch[:0]
+		return err
+	})
+	if err != nil {
+		return rep, err
+	}
+	if err = saveGenes(transaction, batch); err != nil {
+		return rep, err
+	}
+	removed := make([]int, 0, len(known))
+	for _, k := range known {
+		removed = append(removed, k.id)
+	}
+	rep.Changed, rep.Removed = len(changed), len(removed)
+	err = invalidateResults(transaction, genomeID, changed, removed,
+		rep.Added > 0)
+	if err != nil {
+		return rep, err
+	}
+	if err = markLongest(transaction, genomeID); err != nil {
+		return rep, err
+	}
+	if rep.Added > 0 {
+		if err = queueNewGenes(transaction, genomeID); err != nil {
+			return rep, err
 		}
 	}
-	err := scanner.Err()
-	Check(err)
-	return res
+	if err = saveImport(transaction, &rep); err != nil {
+		return rep, err
+	}
+	err = transaction.Commit()
+	return rep, dbError("commit genes", err)
 }
 
-func joinSequence(seq []string) string {
-	return strings.Join(seq, "")
+// knownGenes returns genes of a genome that are in the database already,
+// by their names.
+func knownGenes(db *sql.DB, genomeID int) (map[string]knownGene, error) {
+	res := make(map[string]knownGene)
+	q := `SELECT id, gene, md5(sequence) FROM genes WHERE genome_id = $1`
+	rows, err := db.Query(q, genomeID)
+	if err != nil {
+		return nil, dbError("read genes of a genome", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name string
+		var k knownGene
+		if err := rows.Scan(&k.id, &name, &k.md5); err != nil {
+			return nil, dbError("read genes of a genome", err)
+		}
+		res[name] = k
+	}
+	return res, dbError("read genes of a genome", rows.Err())
 }
 
-func parseGeneHeader(line string) (string, string) {
-	line = strings.Trim(line, "> \n\r")
-	header := strings.SplitN(line, " ", 2)
-	return header[0], header[1]
+// sequenceMD5 returns the same checksum of a sequence as md5() function of
+// Postgres.
+func sequenceMD5(seq []rune) string {
+	return fmt.Sprintf("%x", md5.Sum([]byte(string(seq))))
 }
 
-func saveGenes(db *sql.DB, genes []Gene) {
-	batch := genes
-	columns := []string{"genome_id", "gene", "description", "sequence"}
-	transaction, err := db.Begin()
-	Check(err)
+// updateGene replaces the sequence and annotations of an existing gene.
+func updateGene(transaction *sql.Tx, g Gene) error {
+	q := `UPDATE genes
+	        SET description = $2, sequence = $3, locus = $4, accession = $5,
+	            symbol = $6, organism = $7, biotype = $8, taxon_id = $9,
+	            keywords = $10, go_terms = $11
+	        WHERE id = $1`
+	_, err := transaction.Exec(q, g.ID, g.Desc, string(g.Seq), g.Locus,
+		g.Accession, g.Symbol, g.Organism, g.Biotype, g.TaxonID,
+		textArray(g.Keywords), textArray(g.GO))
+	return dbError("update gene "+g.Gene, err)
+}
 
+// invalidateResults deletes alignments and orthologs of changed and
+// removed genes, and queues jobs again, so runs that involve the genome
+// are completed by the next alignment of the run. Removed genes are
+// deleted with their jobs. If genes were added or changed, every query
+// gene of runs that target the genome has to be aligned again, so all
+// results of these runs are deleted: their best hits may change. If genes
+// were only removed, this is needed only for runs that keep top hits,
+// where a next best target replaces a removed one.
+func invalidateResults(transaction *sql.Tx, genomeID int, changed []int,
+	removed []int, added bool) error {
+	if len(changed) == 0 && len(removed) == 0 && !added {
+		return nil
+	}
+	ids := pq.Array(append(append([]int{}, changed...), removed...))
+	gone := pq.Array(removed)
+	type stmt struct {
+		q    string
+		args []interface{}
+	}
+	stmts := []stmt{
+		{`DELETE FROM genes_matches
+		    WHERE gene_id = ANY($1) OR match_gene_id = ANY($1)`,
+			[]interface{}{ids}},
+		{`DELETE FROM orthologs
+		    WHERE gene_id = ANY($1) OR ortholog_gene_id = ANY($1)`,
+			[]interface{}{ids}},
+		{"DELETE FROM cluster_members WHERE gene_id = ANY($1)",
+			[]interface{}{gone}},
+		{"DELETE FROM jobs WHERE gene_id = ANY($1)", []interface{}{gone}},
+		{"DELETE FROM genes WHERE id = ANY($1)", []interface{}{gone}},
+		{`UPDATE jobs
+		    SET status = 'pending', started_at = NULL, heartbeat_at = NULL,
+		        seq_len = (SELECT length(sequence) FROM genes
+		                     WHERE id = jobs.gene_id)
+		    WHERE gene_id = ANY($1)`, []interface{}{ids}},
+	}
+	if added || len(changed) > 0 || len(removed) > 0 {
+		runs := "SELECT id FROM runs WHERE target_genome_id = $1"
+		if !added && len(changed) == 0 {
+			runs += " AND top_n > 0"
+		}
+		args := []interface{}{genomeID}
+		stmts = append(stmts,
+			stmt{"DELETE FROM genes_matches WHERE run_id IN (" + runs + ")",
+				args},
+			stmt{"DELETE FROM orthologs WHERE run_id IN (" + runs + ")" +
+				" OR reverse_run_id IN (" + runs + ")", args},
+			stmt{`UPDATE jobs
+		    SET status = 'pending', started_at = NULL, heartbeat_at = NULL
+		    WHERE run_id IN (` + runs + ")", args})
+	}
+	for _, s := range stmts {
+		if _, err := transaction.Exec(s.q, s.args...); err != nil {
+			return dbError("invalidate results of changed genes", err)
+		}
+	}
+	return nil
+}
+
+// queueNewGenes creates jobs for genes of a genome that are not queued
+// yet in runs where the genome is the query.
+func queueNewGenes(transaction *sql.Tx, genomeID int) error {
+	q := `INSERT INTO jobs (run_id, gene_id, seq_len)
+	        (SELECT r.id, g.id, length(g.sequence)
+	           FROM runs r
+	             JOIN genes g ON g.genome_id = r.query_genome_id
+	           WHERE r.query_genome_id = $1
+	             AND (g.longest OR NOT r.longest_isoform))
+	        ON CONFLICT (run_id, gene_id) DO NOTHING`
+	_, err := transaction.Exec(q, genomeID)
+	return dbError("create jobs for new genes", err)
+}
+
+// markLongest sets longest for the longest isoform of every locus of a
+// genome. If several isoforms have the same length, the first of them
+// wins.
+func markLongest(transaction *sql.Tx, genomeID int) error {
+	q := `UPDATE genes g
+	        SET longest = (l.rank = 1)
+	        FROM (SELECT id, row_number() OVER
+	                (PARTITION BY locus ORDER BY length(sequence) DESC, id) AS rank
+	                FROM genes
+	                WHERE genome_id = $1) l
+	        WHERE g.id = l.id`
+	_, err := transaction.Exec(q, genomeID)
+	return dbError("find longest isoforms", err)
+}
+
+// saveGenes copies a batch of genes to the database within a transaction.
+func saveGenes(transaction *sql.Tx, genes []Gene) error {
+	if len(genes) == 0 {
+		return nil
+	}
+	columns := []string{"genome_id", "gene", "description", "sequence",
+		"locus", "longest", "accession", "symbol", "organism", "biotype",
+		"taxon_id", "keywords", "go_terms"}
 	stmt, err := transaction.Prepare(pq.CopyIn("genes", columns...))
-	Check(err)
+	if err != nil {
+		return dbError("prepare genes copy", err)
+	}
 
-	for _, p := range batch {
+	for _, p := range genes {
 		_, err = stmt.Exec(p.GenomeID, p.Gene, p.Desc,
-			string(p.Seq))
-		Check(err)
+			string(p.Seq), p.Locus, p.Longest, p.Accession, p.Symbol,
+			p.Organism, p.Biotype, p.TaxonID, textArray(p.Keywords),
+			textArray(p.GO))
+		if err != nil {
+			stmt.Close()
+			return dbError("copy genes", err)
+		}
 	}
 
 	_, err = stmt.Exec()
 	if err != nil {
-		log.Println(`
-Bulk import of titles data failed, probably you need to empty all data
-and start with an empty database.
-`)
-		log.Fatal(err)
+		stmt.Close()
+		return dbError("copy genes, probably you need to start with an "+
+			"empty database", err)
 	}
 
 	err = stmt.Close()
-	Check(err)
+	return dbError("copy genes", err)
+}
 
-	err = transaction.Commit()
-	Check(err)
+// textArray converts a slice for saving into a NOT NULL array column, nil
+// slices become empty arrays instead of NULL.
+func textArray(s []string) interface{} {
+	if s == nil {
+		s = []string{}
+	}
+	return pq.Array(s)
 }
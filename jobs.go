@@ -0,0 +1,165 @@
+package smithwatr
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// ReclaimJobs returns to 'pending' status all jobs that were started, but
+// did not get a heartbeat for longer than the lease time. It happens when
+// a process that claimed the jobs died. Returns the number of reclaimed
+// jobs.
+func ReclaimJobs(db *sql.DB, lease time.Duration) (int, error) {
+	q := `UPDATE jobs
+	        SET status = 'pending', started_at = NULL, heartbeat_at = NULL
+	        WHERE status = 'started'
+	          AND (heartbeat_at IS NULL OR heartbeat_at < now() - $1::interval)`
+	res, err := db.Exec(q, interval(lease))
+	if err != nil {
+		return 0, dbError("reclaim stale jobs", err)
+	}
+	num, err := res.RowsAffected()
+	return int(num), dbError("reclaim stale jobs", err)
+}
+
+func interval(d time.Duration) string {
+	return fmt.Sprintf("%d milliseconds", d.Nanoseconds()/int64(time.Millisecond))
+}
+
+// leaseKeeper keeps track of jobs claimed by the current process and
+// periodically renews their heartbeat, so other processes do not reclaim
+// them.
+type leaseKeeper struct {
+	db    *sql.DB
+	runID int
+	mu    sync.Mutex
+	ids   map[int]struct{}
+	stop  chan struct{}
+}
+
+func newLeaseKeeper(db *sql.DB, runID int,
+	lease time.Duration) *leaseKeeper {
+	lk := &leaseKeeper{db: db, runID: runID, ids: make(map[int]struct{}),
+		stop: make(chan struct{})}
+	go lk.run(lease / 3)
+	return lk
+}
+
+func (lk *leaseKeeper) add(id int) {
+	lk.mu.Lock()
+	lk.ids[id] = struct{}{}
+	lk.mu.Unlock()
+}
+
+func (lk *leaseKeeper) remove(id int) {
+	lk.mu.Lock()
+	delete(lk.ids, id)
+	lk.mu.Unlock()
+}
+
+// claimed returns IDs of jobs that are still held by the process.
+func (lk *leaseKeeper) claimed() []int {
+	lk.mu.Lock()
+	defer lk.mu.Unlock()
+	res := make([]int, 0, len(lk.ids))
+	for id := range lk.ids {
+		res = append(res, id)
+	}
+	return res
+}
+
+func (lk *leaseKeeper) close() {
+	close(lk.stop)
+}
+
+func (lk *leaseKeeper) run(period time.Duration) {
+	ticker := time.NewTicker(period)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-lk.stop:
+			return
+		case <-ticker.C:
+			lk.heartbeat()
+		}
+	}
+}
+
+func (lk *leaseKeeper) heartbeat() {
+	if err := lk.renew(); err != nil {
+		log.Printf("Heartbeat failed: %s", err)
+	}
+}
+
+// renew updates heartbeat time of all jobs held by the leaseKeeper.
+func (lk *leaseKeeper) renew() error {
+	lk.mu.Lock()
+	ids := make([]int64, 0, len(lk.ids))
+	for id := range lk.ids {
+		ids = append(ids, int64(id))
+	}
+	lk.mu.Unlock()
+	if len(ids) == 0 {
+		return nil
+	}
+	q := `UPDATE jobs
+	        SET heartbeat_at = now()
+	        WHERE run_id = $1 AND status = 'started' AND gene_id = ANY($2)`
+	_, err := lk.db.Exec(q, lk.runID, pq.Array(ids))
+	return dbError("renew job leases", err)
+}
+
+// markFinished sets 'finished' status to jobs of a run with given gene IDs.
+func markFinished(db *sql.DB, runID int, ids []int) error {
+	q := `UPDATE jobs
+	        SET status = 'finished'
+	        WHERE run_id = $1 AND gene_id = ANY($2)`
+	_, err := db.Exec(q, runID, pq.Array(ids))
+	return dbError("mark jobs as finished", err)
+}
+
+// releaseJobs returns started jobs of a run with given gene IDs to
+// 'pending' status, so they can be claimed again.
+func releaseJobs(db *sql.DB, runID int, ids []int) error {
+	q := `UPDATE jobs
+	        SET status = 'pending', started_at = NULL, heartbeat_at = NULL
+	        WHERE run_id = $1 AND status = 'started' AND gene_id = ANY($2)`
+	_, err := db.Exec(q, runID, pq.Array(ids))
+	return dbError("release jobs", err)
+}
+
+// jobTracker counts alignments of every claimed job that still have to
+// reach the saver. A job is done when the saver got all its alignments.
+type jobTracker struct {
+	mu      sync.Mutex
+	pending map[int]int
+}
+
+func newJobTracker() *jobTracker {
+	return &jobTracker{pending: make(map[int]int)}
+}
+
+// add registers a job with the number of alignments it produces.
+func (jt *jobTracker) add(id int, num int) {
+	jt.mu.Lock()
+	jt.pending[id] += num
+	jt.mu.Unlock()
+}
+
+// received takes into account an alignment of a job and returns true if
+// it was the last alignment of the job.
+func (jt *jobTracker) received(id int) bool {
+	jt.mu.Lock()
+	defer jt.mu.Unlock()
+	jt.pending[id]--
+	if jt.pending[id] == 0 {
+		delete(jt.pending, id)
+		return true
+	}
+	return false
+}
@@ -0,0 +1,211 @@
+package smithwatr
+
+import (
+	"database/sql"
+	"embed"
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// migrationFiles are SQL files of schema migrations, built into the
+// binary. Names follow the convention of the migrate tool that was used
+// before: <version>_<name>.up.sql and <version>_<name>.down.sql.
+//
+//go:embed scripts/db/*.sql
+var migrationFiles embed.FS
+
+// Migration is one step of the database schema.
+type Migration struct {
+	Version int64
+	Name    string
+	Up      string
+	Down    string
+}
+
+// SchemaError is returned when the database schema does not have the
+// version the code expects.
+type SchemaError struct {
+	Version  int64
+	Expected int64
+	Dirty    bool
+}
+
+func (e *SchemaError) Error() string {
+	if e.Dirty {
+		return fmt.Sprintf("Database schema version %d is dirty, a migration "+
+			"failed half way and has to be fixed by hand", e.Version)
+	}
+	return fmt.Sprintf("Database schema version is %d, expected %d, run "+
+		"'db migrate up'", e.Version, e.Expected)
+}
+
+// Migrations returns all built-in migrations, the oldest first.
+func Migrations() ([]Migration, error) {
+	files, err := migrationFiles.ReadDir("scripts/db")
+	if err != nil {
+		return nil, err
+	}
+	byVersion := make(map[int64]*Migration)
+	for _, f := range files {
+		name := f.Name()
+		parts := strings.SplitN(name, "_", 2)
+		version, err := strconv.ParseInt(parts[0], 10, 64)
+		if err != nil || len(parts) < 2 {
+			return nil, fmt.Errorf("Migration file %s has no version", name)
+		}
+		data, err := migrationFiles.ReadFile(path.Join("scripts/db", name))
+		if err != nil {
+			return nil, err
+		}
+		m, ok := byVersion[version]
+		if !ok {
+			m = &Migration{Version: version}
+			byVersion[version] = m
+		}
+		switch {
+		case strings.HasSuffix(parts[1], ".up.sql"):
+			m.Name = strings.TrimSuffix(parts[1], ".up.sql")
+			m.Up = string(data)
+		case strings.HasSuffix(parts[1], ".down.sql"):
+			m.Down = string(data)
+		}
+	}
+	res := make([]Migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		res = append(res, *m)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].Version < res[j].Version
+	})
+	return res, nil
+}
+
+// SchemaVersion returns the version of the last applied migration, 0 if
+// there is none. The version is kept in schema_migrations table, the same
+// way the migrate tool does it, so existing databases keep their version.
+func SchemaVersion(db *sql.DB) (version int64, dirty bool, err error) {
+	q := `CREATE TABLE IF NOT EXISTS schema_migrations (
+	        version bigint NOT NULL PRIMARY KEY,
+	        dirty boolean NOT NULL)`
+	if _, err = db.Exec(q); err != nil {
+		return 0, false, dbError("create schema_migrations", err)
+	}
+	q = "SELECT version, dirty FROM schema_migrations LIMIT 1"
+	err = db.QueryRow(q).Scan(&version, &dirty)
+	if err == sql.ErrNoRows {
+		return 0, false, nil
+	}
+	return version, dirty, dbError("read schema version", err)
+}
+
+// CheckSchema returns SchemaError if the database schema is not at the
+// version of the last built-in migration.
+func CheckSchema(db *sql.DB) error {
+	ms, err := Migrations()
+	if err != nil {
+		return err
+	}
+	version, dirty, err := SchemaVersion(db)
+	if err != nil {
+		return err
+	}
+	expected := ms[len(ms)-1].Version
+	if dirty || version != expected {
+		return &SchemaError{Version: version, Expected: expected, Dirty: dirty}
+	}
+	return nil
+}
+
+// MigrateUp applies all migrations newer than the current schema version,
+// and returns them.
+func MigrateUp(db *sql.DB) ([]Migration, error) {
+	ms, err := Migrations()
+	if err != nil {
+		return nil, err
+	}
+	version, dirty, err := SchemaVersion(db)
+	if err != nil {
+		return nil, err
+	}
+	if dirty {
+		return nil, &SchemaError{Version: version, Dirty: true}
+	}
+	var res []Migration
+	for _, m := range ms {
+		if m.Version <= version {
+			continue
+		}
+		if err = migrate(db, m.Up, m.Version); err != nil {
+			return res, err
+		}
+		res = append(res, m)
+	}
+	return res, nil
+}
+
+// MigrateDown reverts steps last applied migrations, or all of them if
+// steps is 0, and returns them.
+func MigrateDown(db *sql.DB, steps int) ([]Migration, error) {
+	ms, err := Migrations()
+	if err != nil {
+		return nil, err
+	}
+	version, dirty, err := SchemaVersion(db)
+	if err != nil {
+		return nil, err
+	}
+	if dirty {
+		return nil, &SchemaError{Version: version, Dirty: true}
+	}
+	var res []Migration
+	for i := len(ms) - 1; i >= 0; i-- {
+		if ms[i].Version > version {
+			continue
+		}
+		if steps > 0 && len(res) == steps {
+			break
+		}
+		var prev int64
+		if i > 0 {
+			prev = ms[i-1].Version
+		}
+		if err = migrate(db, ms[i].Down, prev); err != nil {
+			return res, err
+		}
+		res = append(res, ms[i])
+	}
+	return res, nil
+}
+
+// migrate runs SQL of a migration and sets the schema version in one
+// transaction, so a failed migration leaves the schema as it was. Version
+// 0 means that no migrations are applied.
+func migrate(db *sql.DB, sqlText string, version int64) (err error) {
+	op := fmt.Sprintf("migrate to version %d", version)
+	transaction, err := db.Begin()
+	if err != nil {
+		return dbError("start a transaction", err)
+	}
+	defer func() {
+		if err != nil {
+			transaction.Rollback()
+		}
+	}()
+	if _, err = transaction.Exec(sqlText); err != nil {
+		return dbError(op, err)
+	}
+	if _, err = transaction.Exec("DELETE FROM schema_migrations"); err != nil {
+		return dbError(op, err)
+	}
+	if version > 0 {
+		q := "INSERT INTO schema_migrations (version, dirty) VALUES ($1, false)"
+		if _, err = transaction.Exec(q, version); err != nil {
+			return dbError(op, err)
+		}
+	}
+	err = transaction.Commit()
+	return dbError(op, err)
+}
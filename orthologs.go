@@ -0,0 +1,216 @@
+package smithwatr
+
+import (
+	"database/sql"
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/lib/pq"
+)
+
+// Tie handling modes for reciprocal best hits, used when a gene has
+// several best hits with the same score.
+const (
+	// TiesAll accepts every tied best hit.
+	TiesAll = "all"
+	// TiesNone ignores genes that have tied best hits.
+	TiesNone = "none"
+	// TiesFirst takes the tied best hit with the smallest gene ID.
+	TiesFirst = "first"
+)
+
+// RBHOptions configures calculation of reciprocal best hits.
+type RBHOptions struct {
+	Ties        string
+	MinScore    int
+	MinCoverage float32
+}
+
+// BestHit is a hit of a gene with the best score among all its hits.
+type BestHit struct {
+	GeneID      int
+	Gene        string
+	MatchGeneID int
+	MatchGene   string
+	Score       int
+}
+
+// Ortholog is a pair of genes from two genomes which are best hits of each
+// other.
+type Ortholog struct {
+	GeneID         int
+	Gene           string
+	OrthologGeneID int
+	OrthologGene   string
+	Score          int
+	ReverseScore   int
+}
+
+// ReciprocalBestHits finds orthologs between query and target genomes of
+// runAB, using results of runAB and of the opposite run runBA.
+func ReciprocalBestHits(db *sql.DB, runAB Run, runBA Run,
+	opts RBHOptions) ([]Ortholog, error) {
+	if runAB.QueryGenomeID != runBA.TargetGenomeID ||
+		runAB.TargetGenomeID != runBA.QueryGenomeID {
+		return nil, fmt.Errorf("Runs %d and %d are not opposite to each other",
+			runAB.ID, runBA.ID)
+	}
+	ab, err := BestHits(db, runAB, opts)
+	if err != nil {
+		return nil, err
+	}
+	ba, err := BestHits(db, runBA, opts)
+	if err != nil {
+		return nil, err
+	}
+	return ReciprocalHits(ab, ba, opts.Ties), nil
+}
+
+// BestHits returns the best scoring hits of every query gene of a run.
+// Hits with a score or coverage of both genes below the thresholds are
+// ignored. All hits that share the best score are returned.
+func BestHits(db *sql.DB, run Run, opts RBHOptions) ([]BestHit, error) {
+	var res []BestHit
+	q := `WITH ranked AS (
+	        SELECT gene_id, match_gene_id, score,
+	               rank() OVER (PARTITION BY gene_id ORDER BY score DESC) AS r
+	          FROM genes_matches
+	          WHERE run_id = $1 AND score >= $2
+	            AND query_coverage >= $3 AND target_coverage >= $3
+	      )
+	      SELECT r.gene_id, g1.gene, r.match_gene_id, g2.gene, r.score
+	        FROM ranked r
+	          JOIN genes g1 ON g1.id = r.gene_id
+	          JOIN genes g2 ON g2.id = r.match_gene_id
+	        WHERE r.r = 1`
+	rows, err := db.Query(q, run.ID, opts.MinScore, opts.MinCoverage)
+	if err != nil {
+		return nil, dbError("find best hits", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var h BestHit
+		err := rows.Scan(&h.GeneID, &h.Gene, &h.MatchGeneID, &h.MatchGene,
+			&h.Score)
+		if err != nil {
+			return nil, dbError("find best hits", err)
+		}
+		res = append(res, h)
+	}
+	return res, dbError("find best hits", rows.Err())
+}
+
+// ReciprocalHits takes best hits of genome A against genome B and of B
+// against A, and returns pairs that are best hits in both directions.
+// Genes with several equally good hits are treated according to ties.
+func ReciprocalHits(ab []BestHit, ba []BestHit, ties string) []Ortholog {
+	var res []Ortholog
+	abBest := resolveTies(ab, ties)
+	baBest := resolveTies(ba, ties)
+	for _, hits := range abBest {
+		for _, h := range hits {
+			for _, rh := range baBest[h.MatchGeneID] {
+				if rh.MatchGeneID == h.GeneID {
+					res = append(res, Ortholog{GeneID: h.GeneID, Gene: h.Gene,
+						OrthologGeneID: h.MatchGeneID, OrthologGene: h.MatchGene,
+						Score: h.Score, ReverseScore: rh.Score})
+				}
+			}
+		}
+	}
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].GeneID == res[j].GeneID {
+			return res[i].OrthologGeneID < res[j].OrthologGeneID
+		}
+		return res[i].GeneID < res[j].GeneID
+	})
+	return res
+}
+
+// resolveTies groups best hits by gene and drops tied hits according to
+// ties mode.
+func resolveTies(hits []BestHit, ties string) map[int][]BestHit {
+	res := make(map[int][]BestHit)
+	for _, h := range hits {
+		res[h.GeneID] = append(res[h.GeneID], h)
+	}
+	for id, hs := range res {
+		if len(hs) < 2 {
+			continue
+		}
+		switch ties {
+		case TiesNone:
+			delete(res, id)
+		case TiesFirst:
+			first := hs[0]
+			for _, h := range hs[1:] {
+				if h.MatchGeneID < first.MatchGeneID {
+					first = h
+				}
+			}
+			res[id] = []BestHit{first}
+		}
+	}
+	return res
+}
+
+// SaveOrthologs replaces orthologs found for a pair of runs with new ones.
+func SaveOrthologs(db *sql.DB, runAB Run, runBA Run,
+	orthologs []Ortholog) (err error) {
+	columns := []string{"run_id", "reverse_run_id", "gene_id",
+		"ortholog_gene_id", "score", "reverse_score"}
+	transaction, err := db.Begin()
+	if err != nil {
+		return dbError("start a transaction", err)
+	}
+	defer func() {
+		if err != nil {
+			transaction.Rollback()
+		}
+	}()
+
+	_, err = transaction.Exec(`DELETE FROM orthologs
+	                             WHERE run_id = $1 AND reverse_run_id = $2`,
+		runAB.ID, runBA.ID)
+	if err != nil {
+		return dbError("delete old orthologs", err)
+	}
+
+	stmt, err := transaction.Prepare(pq.CopyIn("orthologs", columns...))
+	if err != nil {
+		return dbError("prepare orthologs copy", err)
+	}
+	for _, o := range orthologs {
+		_, err = stmt.Exec(runAB.ID, runBA.ID, o.GeneID, o.OrthologGeneID,
+			o.Score, o.ReverseScore)
+		if err != nil {
+			return dbError("copy orthologs", err)
+		}
+	}
+	if _, err = stmt.Exec(); err != nil {
+		return dbError("copy orthologs", err)
+	}
+	if err = stmt.Close(); err != nil {
+		return dbError("copy orthologs", err)
+	}
+
+	err = transaction.Commit()
+	return dbError("commit orthologs", err)
+}
+
+// WriteOrthologsTSV writes orthologs as tab separated values with a header.
+func WriteOrthologsTSV(w io.Writer, orthologs []Ortholog) error {
+	_, err := fmt.Fprintln(w, "gene\tortholog\tscore\treverse_score")
+	if err != nil {
+		return err
+	}
+	for _, o := range orthologs {
+		_, err = fmt.Fprintf(w, "%s\t%s\t%d\t%d\n", o.Gene, o.OrthologGene,
+			o.Score, o.ReverseScore)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
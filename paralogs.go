@@ -0,0 +1,82 @@
+package smithwatr
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// InParalogs finds groups of in-paralogs of a genome: genes that are more
+// similar to each other than to any gene of a reference genome. selfRun
+// compares the genome with itself, refRun compares it with the reference.
+func InParalogs(db *sql.DB, selfRun Run, refRun Run) ([][]int, error) {
+	if selfRun.QueryGenomeID != selfRun.TargetGenomeID ||
+		refRun.QueryGenomeID != selfRun.QueryGenomeID {
+		return nil, fmt.Errorf("Run %d is not a self comparison of the query "+
+			"genome of run %d", selfRun.ID, refRun.ID)
+	}
+	refBest, err := bestScores(db, refRun)
+	if err != nil {
+		return nil, err
+	}
+
+	var self []Alignment
+	q := `SELECT gene_id, match_gene_id, score
+	        FROM genes_matches
+	        WHERE run_id = $1 AND gene_id <> match_gene_id`
+	rows, err := db.Query(q, selfRun.ID)
+	if err != nil {
+		return nil, dbError("read self hits", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var a Alignment
+		if err := rows.Scan(&a.Gene1.ID, &a.Gene2.ID, &a.Score); err != nil {
+			return nil, dbError("read self hits", err)
+		}
+		self = append(self, a)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, dbError("read self hits", err)
+	}
+	return InParalogGroups(self, refBest), nil
+}
+
+// bestScores returns the best score of every query gene of a run.
+func bestScores(db *sql.DB, run Run) (map[int]int, error) {
+	res := make(map[int]int)
+	q := `SELECT gene_id, max(score)
+	        FROM genes_matches
+	        WHERE run_id = $1
+	        GROUP BY gene_id`
+	rows, err := db.Query(q, run.ID)
+	if err != nil {
+		return nil, dbError("read best scores", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id, score int
+		if err := rows.Scan(&id, &score); err != nil {
+			return nil, dbError("read best scores", err)
+		}
+		res[id] = score
+	}
+	return res, dbError("read best scores", rows.Err())
+}
+
+// InParalogGroups takes alignments of genes of a genome with each other
+// and the best scores of the genes against a reference genome. Two genes
+// are in-paralogs if their alignment scores higher than the best
+// reference hit of each of them. Groups are connected in-paralog pairs.
+func InParalogGroups(self []Alignment, refBest map[int]int) [][]int {
+	g := NewGraph()
+	for _, a := range self {
+		id1, id2 := a.Gene1.ID, a.Gene2.ID
+		if id1 == id2 {
+			continue
+		}
+		if a.Score > refBest[id1] && a.Score > refBest[id2] {
+			g.AddEdge(id1, id2, float64(a.Score))
+		}
+	}
+	return g.SingleLinkage()
+}
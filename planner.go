@@ -0,0 +1,94 @@
+package smithwatr
+
+import (
+	"context"
+	"database/sql"
+	"log"
+)
+
+// GenomeIDs returns IDs of all genomes known to the database.
+func GenomeIDs(db *sql.DB) ([]int, error) {
+	var res []int
+	rows, err := db.Query("SELECT id FROM genomes ORDER BY id")
+	if err != nil {
+		return nil, dbError("list genomes", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, dbError("list genomes", err)
+		}
+		res = append(res, id)
+	}
+	return res, dbError("list genomes", rows.Err())
+}
+
+// PlanRuns creates runs comparing every genome with every other genome and
+// with itself. If ordered is true both directions of every pair are
+// planned, otherwise only pairs where query genome ID is not larger than
+// target genome ID. Runs that are already computed with the same
+// parameters are not returned.
+func PlanRuns(db *sql.DB, conf Env, ordered bool) ([]Run, error) {
+	var res []Run
+	ids, err := GenomeIDs(db)
+	if err != nil {
+		return nil, err
+	}
+	for _, query := range ids {
+		for _, target := range ids {
+			if !ordered && query > target {
+				continue
+			}
+			run, err := FindOrCreateRun(db, query, target, conf)
+			if err != nil {
+				return nil, err
+			}
+			finished, err := RunFinished(db, run)
+			if err != nil {
+				return nil, err
+			}
+			if finished {
+				log.Printf("Skipping run %d (%d vs %d), already computed",
+					run.ID, query, target)
+				continue
+			}
+			res = append(res, run)
+		}
+	}
+	return res, nil
+}
+
+// RunFinished returns true if a run has jobs and all of them are finished.
+func RunFinished(db *sql.DB, run Run) (bool, error) {
+	var total, finished int
+	q := `SELECT count(*), count(*) FILTER (WHERE status = 'finished')
+	        FROM jobs
+	        WHERE run_id = $1`
+	err := db.QueryRow(q, run.ID).Scan(&total, &finished)
+	if err != nil {
+		return false, dbError("count jobs of a run", err)
+	}
+	return total > 0 && total == finished, nil
+}
+
+// AlignAll queues jobs for every run and aligns them one after another
+// using the worker pool of Align. It stops after the current run when ctx
+// is cancelled.
+func AlignAll(ctx context.Context, db *sql.DB, runs []Run, b62 Blosum62,
+	conf Env) error {
+	for i, run := range runs {
+		if ctx.Err() != nil {
+			return nil
+		}
+		log.Printf("Run %d of %d: genome %d vs genome %d", i+1, len(runs),
+			run.QueryGenomeID, run.TargetGenomeID)
+		if err := ImportJobs(db, run); err != nil {
+			return err
+		}
+		if err := Align(ctx, db, run, -1, b62, conf); err != nil {
+			return err
+		}
+	}
+	return nil
+}
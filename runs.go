@@ -0,0 +1,150 @@
+package smithwatr
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// Run is a comparison of all genes of a query genome against all genes of a
+// target genome with a particular set of alignment parameters. Every run
+// has its own jobs, so several runs can be queued, tracked and resumed
+// independently.
+type Run struct {
+	ID             int
+	QueryGenomeID  int
+	TargetGenomeID int
+	GapOpens       int
+	GapExtends     int
+	// TopN is always 0 when a genome is compared with itself: only one
+	// triangle of such comparison is aligned, so a limit per query gene
+	// would drop hits of genes with larger IDs.
+	TopN        int
+	MinScore    int
+	MinIdentity float32
+	MaxEvalue   float64
+	// LongestIsoform restricts the run to the longest isoform of every gene.
+	LongestIsoform bool
+}
+
+// RunProgress shows how many jobs of a run are in each status.
+type RunProgress struct {
+	Run
+	Pending  int
+	Started  int
+	Finished int
+}
+
+// newRun creates a run for the given genomes with alignment parameters
+// from conf. Self comparisons get TopN 0, so runs that compute the same
+// results are the same run.
+func newRun(queryGenome int, targetGenome int, conf Env) Run {
+	run := Run{QueryGenomeID: queryGenome, TargetGenomeID: targetGenome,
+		GapOpens: conf.GapOpens, GapExtends: conf.GapExtends, TopN: conf.TopN,
+		MinScore: conf.MinScore, MinIdentity: conf.MinIdentity,
+		MaxEvalue: conf.MaxEvalue, LongestIsoform: conf.LongestIsoform}
+	if queryGenome == targetGenome {
+		run.TopN = 0
+	}
+	return run
+}
+
+// FindOrCreateRun returns a run for the given genomes and alignment
+// parameters from conf. If such run does not exist yet, it is created.
+func FindOrCreateRun(db *sql.DB, queryGenome int, targetGenome int,
+	conf Env) (Run, error) {
+	run := newRun(queryGenome, targetGenome, conf)
+	q := `INSERT INTO runs (query_genome_id, target_genome_id,
+	                        gap_open, gap_extend,
+	                        top_n, min_score, min_identity, max_evalue,
+	                        longest_isoform)
+	        VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+	        ON CONFLICT (query_genome_id, target_genome_id, gap_open, gap_extend,
+	                     top_n, min_score, min_identity, max_evalue,
+	                     longest_isoform)
+	          DO UPDATE SET gap_open = EXCLUDED.gap_open
+	        RETURNING id`
+	err := db.QueryRow(q, run.QueryGenomeID, run.TargetGenomeID,
+		run.GapOpens, run.GapExtends, run.TopN, run.MinScore,
+		run.MinIdentity, run.MaxEvalue, run.LongestIsoform).Scan(&run.ID)
+	return run, dbError("create a run", err)
+}
+
+// FindRun returns an existing run for the given genomes and parameters
+// from conf.
+func FindRun(db *sql.DB, queryGenome int, targetGenome int,
+	conf Env) (Run, error) {
+	run := newRun(queryGenome, targetGenome, conf)
+	q := `SELECT id FROM runs
+	        WHERE query_genome_id = $1 AND target_genome_id = $2
+	          AND gap_open = $3 AND gap_extend = $4 AND top_n = $5
+	          AND min_score = $6 AND min_identity = $7 AND max_evalue = $8
+	          AND longest_isoform = $9`
+	err := db.QueryRow(q, run.QueryGenomeID, run.TargetGenomeID,
+		run.GapOpens, run.GapExtends, run.TopN, run.MinScore,
+		run.MinIdentity, run.MaxEvalue, run.LongestIsoform).Scan(&run.ID)
+	return run, dbError(fmt.Sprintf("find run of genome %d vs genome %d",
+		queryGenome, targetGenome), err)
+}
+
+// GetRun returns a run by its ID.
+func GetRun(db *sql.DB, id int) (Run, error) {
+	run := Run{ID: id}
+	q := `SELECT query_genome_id, target_genome_id, gap_open, gap_extend,
+	             top_n, min_score, min_identity, max_evalue, longest_isoform
+	        FROM runs
+	        WHERE id = $1`
+	err := db.QueryRow(q, id).Scan(&run.QueryGenomeID, &run.TargetGenomeID,
+		&run.GapOpens, &run.GapExtends, &run.TopN, &run.MinScore,
+		&run.MinIdentity, &run.MaxEvalue, &run.LongestIsoform)
+	return run, dbError(fmt.Sprintf("find run %d", id), err)
+}
+
+// ListRuns returns all runs with the number of their jobs in each status.
+func ListRuns(db *sql.DB) ([]RunProgress, error) {
+	var res []RunProgress
+	q := `SELECT r.id, r.query_genome_id, r.target_genome_id,
+	             r.gap_open, r.gap_extend,
+	             r.top_n, r.min_score, r.min_identity, r.max_evalue,
+	             r.longest_isoform,
+	             count(*) FILTER (WHERE j.status = 'pending'),
+	             count(*) FILTER (WHERE j.status = 'started'),
+	             count(*) FILTER (WHERE j.status = 'finished')
+	        FROM runs r
+	          LEFT OUTER JOIN jobs j ON j.run_id = r.id
+	        GROUP BY r.id
+	        ORDER BY r.id`
+	rows, err := db.Query(q)
+	if err != nil {
+		return nil, dbError("list runs", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var rp RunProgress
+		err := rows.Scan(&rp.ID, &rp.QueryGenomeID, &rp.TargetGenomeID,
+			&rp.GapOpens, &rp.GapExtends, &rp.TopN, &rp.MinScore,
+			&rp.MinIdentity, &rp.MaxEvalue, &rp.LongestIsoform, &rp.Pending,
+			&rp.Started, &rp.Finished)
+		if err != nil {
+			return nil, dbError("list runs", err)
+		}
+		res = append(res, rp)
+	}
+	return res, dbError("list runs", rows.Err())
+}
+
+// apply returns a copy of conf with alignment and filtering parameters of
+// the run. Self comparisons keep all hits that pass thresholds, even if
+// the run was stored with TopN before it was normalized.
+func (r Run) apply(conf Env) Env {
+	conf.GapOpens = r.GapOpens
+	conf.GapExtends = r.GapExtends
+	conf.TopN = r.TopN
+	if r.QueryGenomeID == r.TargetGenomeID {
+		conf.TopN = 0
+	}
+	conf.MinScore = r.MinScore
+	conf.MinIdentity = r.MinIdentity
+	conf.MaxEvalue = r.MaxEvalue
+	conf.LongestIsoform = r.LongestIsoform
+	return conf
+}
@@ -0,0 +1,132 @@
+package smithwatr
+
+import (
+	"log"
+	"strconv"
+	"sync"
+)
+
+// matrixCell and sliceHeader are sizes in bytes of a cell of ScoreMatrix
+// and of a header of its row.
+const (
+	matrixCell  = strconv.IntSize / 8
+	sliceHeader = 3 * strconv.IntSize / 8
+)
+
+// PairMemory estimates how many bytes an alignment of sequences with
+// lengths n and m needs for its score matrix of (n+1)*(m+1) cells.
+func PairMemory(n int, m int) int64 {
+	return int64(n+1) * (int64(m+1)*matrixCell + sliceHeader)
+}
+
+// MemoryScheduler admits alignments to workers so that the memory of their
+// score matrices stays under a budget. Alignments are admitted in the
+// order they ask, so a large one is not starved by smaller ones. An
+// alignment that is larger than the whole budget runs alone. A nil
+// scheduler, or a budget of 0, admits everything at once. The scheduler
+// does not reorder pairs, long sequences are put first by longestFirst
+// before pairs reach it.
+type MemoryScheduler struct {
+	budget  int64
+	workers int
+	mu      sync.Mutex
+	used    int64
+	peak    int64
+	queue   []*memoryRequest
+}
+
+type memoryRequest struct {
+	size  int64
+	ready chan struct{}
+}
+
+// NewMemoryScheduler creates a scheduler for a memory budget in bytes
+// shared by a number of workers.
+func NewMemoryScheduler(budget int64, workers int) *MemoryScheduler {
+	if workers < 1 {
+		workers = 1
+	}
+	return &MemoryScheduler{budget: budget, workers: workers}
+}
+
+// Acquire blocks until size bytes fit into the budget, and reserves them.
+func (s *MemoryScheduler) Acquire(size int64) {
+	if s == nil || s.budget <= 0 {
+		return
+	}
+	s.mu.Lock()
+	if len(s.queue) == 0 && s.fits(size) {
+		s.reserve(size)
+		s.mu.Unlock()
+		return
+	}
+	if size > s.budget {
+		log.Printf("Alignment needs %d bytes, more than the memory budget "+
+			"of %d, it runs alone", size, s.budget)
+	}
+	req := &memoryRequest{size: size, ready: make(chan struct{})}
+	s.queue = append(s.queue, req)
+	s.mu.Unlock()
+	<-req.ready
+}
+
+// Release returns size bytes to the budget, and admits waiting alignments
+// that fit now.
+func (s *MemoryScheduler) Release(size int64) {
+	if s == nil || s.budget <= 0 {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.used -= size
+	for len(s.queue) > 0 && s.fits(s.queue[0].size) {
+		req := s.queue[0]
+		s.queue = s.queue[1:]
+		s.reserve(req.size)
+		close(req.ready)
+	}
+}
+
+// InUse returns the number of reserved bytes.
+func (s *MemoryScheduler) InUse() int64 {
+	if s == nil {
+		return 0
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.used
+}
+
+// Peak returns the largest number of bytes that were reserved at once.
+func (s *MemoryScheduler) Peak() int64 {
+	if s == nil {
+		return 0
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.peak
+}
+
+func (s *MemoryScheduler) reserve(size int64) {
+	s.used += size
+	if s.used > s.peak {
+		s.peak = s.used
+	}
+}
+
+func (s *MemoryScheduler) fits(size int64) bool {
+	return s.used == 0 || s.used+size <= s.budget
+}
+
+// matcher returns a Matcher for a worker. With a budget the Matcher keeps
+// a buffer of at most a fair share of the budget per worker.
+func (s *MemoryScheduler) matcher() Matcher {
+	if s == nil || s.budget <= 0 {
+		return Matcher{}
+	}
+	cells := int(s.budget / int64(s.workers) / matrixCell)
+	if cells < 1 {
+		cells = 1
+	}
+	return Matcher{maxCells: cells}
+}
@@ -0,0 +1,4 @@
+DROP INDEX IF EXISTS heartbeat_index;
+
+ALTER TABLE jobs DROP COLUMN IF EXISTS heartbeat_at;
+ALTER TABLE jobs DROP COLUMN IF EXISTS started_at;
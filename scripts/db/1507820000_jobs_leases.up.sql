@@ -0,0 +1,4 @@
+ALTER TABLE jobs ADD COLUMN started_at timestamp;
+ALTER TABLE jobs ADD COLUMN heartbeat_at timestamp;
+
+CREATE INDEX heartbeat_index ON jobs USING btree (status, heartbeat_at);
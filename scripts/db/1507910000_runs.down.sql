@@ -0,0 +1,21 @@
+-- the old tables keep one row for every gene or pair of genes, rows of
+-- the earliest run are kept
+DELETE FROM genes_matches m
+  USING genes_matches e
+  WHERE e.gene_id = m.gene_id AND e.match_gene_id = m.match_gene_id
+    AND e.run_id < m.run_id;
+ALTER TABLE genes_matches DROP CONSTRAINT genes_matches_pkey;
+ALTER TABLE genes_matches DROP COLUMN IF EXISTS run_id;
+ALTER TABLE genes_matches ADD CONSTRAINT genes_matches_pkey
+  PRIMARY KEY (gene_id, match_gene_id);
+
+DELETE FROM jobs j
+  USING jobs e
+  WHERE e.gene_id = j.gene_id AND e.run_id < j.run_id;
+DROP INDEX IF EXISTS status_index;
+ALTER TABLE jobs DROP CONSTRAINT jobs_pkey;
+ALTER TABLE jobs DROP COLUMN IF EXISTS run_id;
+ALTER TABLE jobs ADD CONSTRAINT jobs_pkey PRIMARY KEY (gene_id);
+CREATE INDEX status_index ON jobs USING btree (status);
+
+DROP TABLE IF EXISTS runs;
@@ -0,0 +1,50 @@
+CREATE TABLE runs (
+    id serial NOT NULL,
+    query_genome_id int NOT NULL,
+    target_genome_id int NOT NULL,
+    gap_open int NOT NULL,
+    gap_extend int NOT NULL,
+    created_at timestamp NOT NULL DEFAULT now(),
+    CONSTRAINT runs_pkey PRIMARY KEY (id)
+);
+
+CREATE UNIQUE INDEX runs_params_index ON runs
+  USING btree (query_genome_id, target_genome_id, gap_open, gap_extend);
+
+-- matches computed before runs existed belong to a run of every pair of
+-- genomes they compare, with the default gap penalties of that time
+INSERT INTO runs (query_genome_id, target_genome_id, gap_open, gap_extend)
+  (SELECT DISTINCT q.genome_id, t.genome_id, 10, 1
+     FROM genes_matches m
+       JOIN genes q ON q.id = m.gene_id
+       JOIN genes t ON t.id = m.match_gene_id);
+
+ALTER TABLE genes_matches ADD COLUMN run_id int;
+UPDATE genes_matches m
+  SET run_id = r.id
+  FROM genes q, genes t, runs r
+  WHERE q.id = m.gene_id AND t.id = m.match_gene_id
+    AND r.query_genome_id = q.genome_id AND r.target_genome_id = t.genome_id;
+-- matches of genes that do not exist anymore belong to no run
+DELETE FROM genes_matches WHERE run_id IS NULL;
+ALTER TABLE genes_matches ALTER COLUMN run_id SET NOT NULL;
+ALTER TABLE genes_matches DROP CONSTRAINT genes_matches_pkey;
+ALTER TABLE genes_matches ADD CONSTRAINT genes_matches_pkey
+  PRIMARY KEY (run_id, gene_id, match_gene_id);
+
+-- the queue of query genes goes to the runs of their genome; a queue
+-- without any matches has no known target, ImportJobs recreates it for
+-- a run
+ALTER TABLE jobs DROP CONSTRAINT jobs_pkey;
+ALTER TABLE jobs ADD COLUMN run_id int;
+INSERT INTO jobs (run_id, gene_id, status)
+  (SELECT r.id, j.gene_id, j.status
+     FROM jobs j
+       JOIN genes g ON g.id = j.gene_id
+       JOIN runs r ON r.query_genome_id = g.genome_id
+     WHERE j.run_id IS NULL);
+DELETE FROM jobs WHERE run_id IS NULL;
+ALTER TABLE jobs ALTER COLUMN run_id SET NOT NULL;
+ALTER TABLE jobs ADD CONSTRAINT jobs_pkey PRIMARY KEY (run_id, gene_id);
+DROP INDEX IF EXISTS status_index;
+CREATE INDEX status_index ON jobs USING btree (run_id, status);
@@ -0,0 +1,13 @@
+ALTER TABLE genes_matches DROP COLUMN IF EXISTS evalue;
+ALTER TABLE genes_matches DROP COLUMN IF EXISTS bit_score;
+
+DROP INDEX IF EXISTS runs_params_index;
+DELETE FROM runs
+  WHERE top_n <> 0 OR min_score <> 0 OR min_identity <> 0 OR max_evalue <> 0;
+CREATE UNIQUE INDEX runs_params_index ON runs
+  USING btree (query_genome_id, target_genome_id, gap_open, gap_extend);
+
+ALTER TABLE runs DROP COLUMN IF EXISTS max_evalue;
+ALTER TABLE runs DROP COLUMN IF EXISTS min_identity;
+ALTER TABLE runs DROP COLUMN IF EXISTS min_score;
+ALTER TABLE runs DROP COLUMN IF EXISTS top_n;
@@ -0,0 +1,12 @@
+ALTER TABLE runs ADD COLUMN top_n int NOT NULL DEFAULT 0;
+ALTER TABLE runs ADD COLUMN min_score int NOT NULL DEFAULT 0;
+ALTER TABLE runs ADD COLUMN min_identity float NOT NULL DEFAULT 0;
+ALTER TABLE runs ADD COLUMN max_evalue float NOT NULL DEFAULT 0;
+
+DROP INDEX IF EXISTS runs_params_index;
+CREATE UNIQUE INDEX runs_params_index ON runs
+  USING btree (query_genome_id, target_genome_id, gap_open, gap_extend,
+               top_n, min_score, min_identity, max_evalue);
+
+ALTER TABLE genes_matches ADD COLUMN bit_score float NOT NULL DEFAULT 0;
+ALTER TABLE genes_matches ADD COLUMN evalue float NOT NULL DEFAULT 0;
@@ -0,0 +1,4 @@
+DROP TABLE IF EXISTS orthologs;
+
+ALTER TABLE genes_matches DROP COLUMN IF EXISTS target_coverage;
+ALTER TABLE genes_matches DROP COLUMN IF EXISTS query_coverage;
@@ -0,0 +1,15 @@
+ALTER TABLE genes_matches ADD COLUMN query_coverage float NOT NULL DEFAULT 0;
+ALTER TABLE genes_matches ADD COLUMN target_coverage float NOT NULL DEFAULT 0;
+
+CREATE TABLE orthologs (
+    run_id int NOT NULL,
+    reverse_run_id int NOT NULL,
+    gene_id int NOT NULL,
+    ortholog_gene_id int NOT NULL,
+    score int NOT NULL,
+    reverse_score int NOT NULL,
+    CONSTRAINT orthologs_pkey
+      PRIMARY KEY (run_id, reverse_run_id, gene_id, ortholog_gene_id)
+);
+
+CREATE INDEX ortholog_gene_index ON orthologs USING btree (ortholog_gene_id);
@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS cluster_members;
+DROP TABLE IF EXISTS clusterings;
@@ -0,0 +1,20 @@
+CREATE TABLE clusterings (
+    id serial NOT NULL,
+    method character varying(255) NOT NULL,
+    weight character varying(255) NOT NULL,
+    inflation float NOT NULL,
+    min_weight float NOT NULL,
+    run_ids int[] NOT NULL,
+    created_at timestamp NOT NULL DEFAULT now(),
+    CONSTRAINT clusterings_pkey PRIMARY KEY (id)
+);
+
+CREATE TABLE cluster_members (
+    clustering_id int NOT NULL,
+    cluster_id int NOT NULL,
+    gene_id int NOT NULL,
+    CONSTRAINT cluster_members_pkey PRIMARY KEY (clustering_id, gene_id)
+);
+
+CREATE INDEX cluster_index ON cluster_members
+  USING btree (clustering_id, cluster_id);
@@ -0,0 +1,11 @@
+DROP INDEX IF EXISTS runs_params_index;
+DELETE FROM runs WHERE longest_isoform;
+CREATE UNIQUE INDEX runs_params_index ON runs
+  USING btree (query_genome_id, target_genome_id, gap_open, gap_extend,
+               top_n, min_score, min_identity, max_evalue);
+
+ALTER TABLE runs DROP COLUMN IF EXISTS longest_isoform;
+
+DROP INDEX IF EXISTS genes_locus_index;
+ALTER TABLE genes DROP COLUMN IF EXISTS longest;
+ALTER TABLE genes DROP COLUMN IF EXISTS locus;
@@ -0,0 +1,11 @@
+ALTER TABLE genes ADD COLUMN locus character varying(255) NOT NULL DEFAULT '';
+ALTER TABLE genes ADD COLUMN longest boolean NOT NULL DEFAULT true;
+UPDATE genes SET locus = gene;
+CREATE INDEX genes_locus_index ON genes USING btree (genome_id, locus);
+
+ALTER TABLE runs ADD COLUMN longest_isoform boolean NOT NULL DEFAULT false;
+
+DROP INDEX IF EXISTS runs_params_index;
+CREATE UNIQUE INDEX runs_params_index ON runs
+  USING btree (query_genome_id, target_genome_id, gap_open, gap_extend,
+               top_n, min_score, min_identity, max_evalue, longest_isoform);
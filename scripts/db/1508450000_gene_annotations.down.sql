@@ -0,0 +1,7 @@
+DROP INDEX IF EXISTS genes_symbol_index;
+DROP INDEX IF EXISTS genes_accession_index;
+
+ALTER TABLE genes DROP COLUMN IF EXISTS biotype;
+ALTER TABLE genes DROP COLUMN IF EXISTS organism;
+ALTER TABLE genes DROP COLUMN IF EXISTS symbol;
+ALTER TABLE genes DROP COLUMN IF EXISTS accession;
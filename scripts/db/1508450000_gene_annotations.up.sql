@@ -0,0 +1,7 @@
+ALTER TABLE genes ADD COLUMN accession character varying(255) NOT NULL DEFAULT '';
+ALTER TABLE genes ADD COLUMN symbol character varying(255) NOT NULL DEFAULT '';
+ALTER TABLE genes ADD COLUMN organism character varying(255) NOT NULL DEFAULT '';
+ALTER TABLE genes ADD COLUMN biotype character varying(255) NOT NULL DEFAULT '';
+
+CREATE INDEX genes_accession_index ON genes USING btree (accession);
+CREATE INDEX genes_symbol_index ON genes USING btree (symbol);
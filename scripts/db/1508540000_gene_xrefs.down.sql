@@ -0,0 +1,6 @@
+DROP INDEX IF EXISTS genes_go_terms_index;
+DROP INDEX IF EXISTS genes_keywords_index;
+
+ALTER TABLE genes DROP COLUMN IF EXISTS go_terms;
+ALTER TABLE genes DROP COLUMN IF EXISTS keywords;
+ALTER TABLE genes DROP COLUMN IF EXISTS taxon_id;
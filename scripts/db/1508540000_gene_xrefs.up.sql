@@ -0,0 +1,6 @@
+ALTER TABLE genes ADD COLUMN taxon_id int NOT NULL DEFAULT 0;
+ALTER TABLE genes ADD COLUMN keywords text[] NOT NULL DEFAULT '{}';
+ALTER TABLE genes ADD COLUMN go_terms text[] NOT NULL DEFAULT '{}';
+
+CREATE INDEX genes_keywords_index ON genes USING gin (keywords);
+CREATE INDEX genes_go_terms_index ON genes USING gin (go_terms);
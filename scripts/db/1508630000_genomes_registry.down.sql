@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS genomes_file_name_index;
+
+ALTER TABLE genomes DROP COLUMN IF EXISTS taxon_id;
@@ -0,0 +1,11 @@
+ALTER TABLE genomes ADD COLUMN taxon_id int NOT NULL DEFAULT 0;
+
+UPDATE genomes SET taxon_id = 3702
+  WHERE file_name = 'Araport11_genes.201606.pep.fasta.gz';
+UPDATE genomes SET taxon_id = 6239
+  WHERE file_name = 'Caenorhabditis_elegans.WBcel235.pep.all.fa.gz';
+UPDATE genomes SET taxon_id = 9606
+  WHERE file_name = 'Homo_sapiens.GRCh38.pep.all.fa.gz';
+
+CREATE UNIQUE INDEX genomes_file_name_index ON genomes
+  USING btree (file_name);
@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS genes_match_gene_index;
+DROP TABLE IF EXISTS imports;
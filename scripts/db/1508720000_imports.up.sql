@@ -0,0 +1,17 @@
+CREATE TABLE imports (
+    id serial NOT NULL,
+    genome_id int NOT NULL,
+    file_name text NOT NULL,
+    checksum character(64) NOT NULL,
+    size bigint NOT NULL,
+    added int NOT NULL,
+    removed int NOT NULL,
+    changed int NOT NULL,
+    unchanged int NOT NULL,
+    imported_at timestamp NOT NULL DEFAULT now(),
+    CONSTRAINT imports_pkey PRIMARY KEY (id)
+);
+
+CREATE INDEX imports_genome_index ON imports USING btree (genome_id, id);
+CREATE INDEX genes_match_gene_index ON genes_matches
+  USING btree (match_gene_id);
@@ -0,0 +1,5 @@
+INSERT INTO genomes (file_name, species, species_short, taxon_id) VALUES
+('Araport11_genes.201606.pep.fasta.gz', 'Arabidopsis thaliana (L.) Heynh.', 'Arabidopsis', 3702),
+('Caenorhabditis_elegans.WBcel235.pep.all.fa.gz', 'Caenorhabditis elegans (Maupas, 1900)', 'C. elegans', 6239),
+('Homo_sapiens.GRCh38.pep.all.fa.gz', 'Homo sapiens L. 1958', 'Homo sapiens', 9606)
+ON CONFLICT (file_name) DO NOTHING;
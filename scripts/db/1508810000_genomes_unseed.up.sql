@@ -0,0 +1,9 @@
+DELETE FROM genomes g
+  WHERE g.file_name IN ('Araport11_genes.201606.pep.fasta.gz',
+                        'Caenorhabditis_elegans.WBcel235.pep.all.fa.gz',
+                        'Homo_sapiens.GRCh38.pep.all.fa.gz')
+    AND NOT EXISTS (SELECT 1 FROM genes WHERE genome_id = g.id)
+    AND NOT EXISTS (SELECT 1 FROM imports WHERE genome_id = g.id);
+
+SELECT setval('genomes_id_seq',
+              COALESCE((SELECT max(id) FROM genomes), 0) + 1, false);
@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS jobs_priority_index;
+ALTER TABLE jobs DROP COLUMN IF EXISTS seq_len;
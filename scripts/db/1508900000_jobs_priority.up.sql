@@ -0,0 +1,8 @@
+ALTER TABLE jobs ADD COLUMN seq_len int NOT NULL DEFAULT 0;
+UPDATE jobs j
+  SET seq_len = length(g.sequence)
+  FROM genes g
+  WHERE g.id = j.gene_id;
+
+CREATE INDEX jobs_priority_index ON jobs
+  USING btree (run_id, status, seq_len DESC, gene_id);
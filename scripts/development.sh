@@ -20,8 +20,8 @@ function touch_bhlindex_db {
 
 function development {
   touch_bhlindex_db
-  migrate -database postgres://${POSTGRES_USER}@${POSTGRES_HOST}:5432/${POSTGRES_DB}?sslmode=disable -path ${dir}/db drop
-  migrate -database postgres://${POSTGRES_USER}@${POSTGRES_HOST}:5432/${POSTGRES_DB}?sslmode=disable -path ${dir}/db up
+  go run ${dir}/../cli db migrate down all
+  go run ${dir}/../cli db migrate up
   ginkgo watch
 }
 
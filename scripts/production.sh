@@ -6,7 +6,7 @@ dir=$(dirname ${BASH_SOURCE[0]})
 
 
 function production {
-  ${dir}/migrate -database postgres://${POSTGRES_USER}@${POSTGRES_HOST}:5432/${POSTGRES_DB}?sslmode=disable -path ${dir}/db up
+  smithwatr db migrate up
 }
 
 
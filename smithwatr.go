@@ -1,73 +1,88 @@
 package smithwatr
 
-import (
-	"database/sql"
-	"fmt"
-	"math"
-	"os"
-	"runtime"
-	"strconv"
-	"strings"
-
-	_ "github.com/lib/pq"
-)
+import "time"
 
 type Blosum62 map[rune]map[rune]int
 
-// Env is a collection of environment variables.
+// Defaults of configuration settings.
+const (
+	defaultJobLease      = 10 * time.Minute
+	defaultSaveBatchSize = 1000
+	defaultSaveInterval  = 30 * time.Second
+	defaultSaveRetries   = 3
+)
+
+// Env is the effective configuration, see LoadConfig.
 type Env struct {
-	DbHost     string
-	DbUser     string
-	Db         string
+	DbHost string
+	DbUser string
+	Db     string
+	DbPort int
+	// DbPassword is used for the database user, if it is empty the password
+	// is looked up in DbPassFile.
+	DbPassword string
+	// DbPassFile is a password file in the format of ~/.pgpass.
+	DbPassFile string
+	// DbSSLMode is one of disable, require, verify-ca, verify-full.
+	DbSSLMode     string
+	DbSSLCert     string
+	DbSSLKey      string
+	DbSSLRootCert string
+	DbAppName     string
+	// DbDSN is a complete connection string or URL, it replaces all other
+	// connection settings except the pool size.
+	DbDSN string
+	// DbMaxOpenConns limits open connections, 0 means no limit.
+	DbMaxOpenConns int
+	DbMaxIdleConns int
+	// DbConnectRetries is how many times the first connection is attempted
+	// again if the database is not reachable yet.
+	DbConnectRetries int
+
 	DataDir    string
 	GapOpens   int
 	GapExtends int
 	WorkersNum int
+	// MemoryBudget limits bytes used by score matrices of alignments that
+	// run at the same time, 0 means no limit.
+	MemoryBudget int64
+	JobLease     time.Duration
+	// SaveBatchSize is the max number of alignments saved in one transaction.
+	SaveBatchSize int
+	// SaveInterval is the max time alignments wait before they are saved.
+	SaveInterval time.Duration
+	// SaveRetries is how many times a failed save is repeated.
+	SaveRetries int
+	// TopN is the number of best hits kept for every query gene, 0 keeps all.
+	// Self comparisons of a genome always keep all hits.
+	TopN int
+	// MinScore is the smallest score of a kept hit.
+	MinScore int
+	// MinIdentity is the smallest identity percent of a kept hit.
+	MinIdentity float32
+	// MaxEvalue is the largest E-value of a kept hit, 0 means no limit.
+	MaxEvalue float64
+	// StrictFasta stops import on any problem in FASTA files, instead of
+	// fixing or skipping problematic records with a warning.
+	StrictFasta bool
+	// LongestIsoform makes new runs align only the longest isoform of every
+	// gene.
+	LongestIsoform bool
+	// RBH contains settings for reciprocal best hits.
+	RBH RBHOptions
+	// Cluster contains settings for protein family clustering.
+	Cluster ClusterOptions
 }
 
-// Check handles error checking, and panicks if error is not nil.
+// Check handles error checking, and panicks if error is not nil. Functions
+// of the package return errors, Check is a shortcut for programs that
+// cannot do anything useful after an error.
 func Check(err error) {
 	if err != nil {
 		panic(err)
 	}
 }
 
-// EnvVars imports all environment variables relevant for the data conversion.
-func EnvVars() Env {
-	emptyEnvs := make([]string, 0, 4)
-	envVars := [7]string{"POSTGRES_HOST", "POSTGRES_USER", "POSTGRES_DB",
-		"DATA_DIR", "GAP_OPEN_PENTALTY", "GAP_EXTENSION_PENALTY", "CPU_CAPACITY"}
-	for i, v := range envVars {
-		val, ok := os.LookupEnv(v)
-		if ok {
-			envVars[i] = val
-		} else {
-			emptyEnvs = append(emptyEnvs, v)
-		}
-	}
-	if len(emptyEnvs) > 0 {
-		envs := strings.Join(emptyEnvs, ", ")
-		panic(fmt.Errorf("Environment variables %s are not defined", envs))
-	}
-
-	gopen, err := strconv.Atoi(envVars[4])
-	Check(err)
-	gext, err := strconv.Atoi(envVars[5])
-	Check(err)
-
-	return Env{DbHost: envVars[0], DbUser: envVars[1], Db: envVars[2],
-		DataDir: envVars[3], GapOpens: gopen, GapExtends: gext,
-		WorkersNum: calculateWorkersNum(envVars[6])}
-}
-
-func calculateWorkersNum(cpuLoad string) int {
-	load, err := strconv.ParseFloat(cpuLoad, 64)
-	Check(err)
-	cpuNum := runtime.NumCPU()
-	workersNum := int(math.Ceil(float64(cpuNum) * load))
-	return workersNum
-}
-
 // InitBlosum62 creates a map with BLOSSUM62 weights values
 func InitBlosum62() Blosum62 {
 	b62 := make(Blosum62)
@@ -170,12 +185,3 @@ func InitBlosum62() Blosum62 {
 		'Z': -4, 'X': -4, '*': 1}
 	return b62
 }
-
-func Connect(conf Env) (*sql.DB, error) {
-	var db *sql.DB
-	var err error
-	params := fmt.Sprintf("postgres://%s@%s/%s?sslmode=disable",
-		conf.DbUser, conf.DbHost, conf.Db)
-	db, err = sql.Open("postgres", params)
-	return db, err
-}
@@ -22,9 +22,25 @@ func TestSmithwatr(t *testing.T) {
 var _ = BeforeSuite(func() {
 	var err error
 	b62 = InitBlosum62()
-	conf = EnvVars()
+	conf, err = EnvVars()
+	Expect(err).NotTo(HaveOccurred())
 	db, err = Connect(conf)
 	Expect(err).NotTo(HaveOccurred())
+	// specs refer to these genomes by IDs 1, 2 and 3
+	for _, g := range []Genome{
+		{FileName: "Araport11_genes.201606.pep.fasta.gz",
+			Species:      "Arabidopsis thaliana (L.) Heynh.",
+			SpeciesShort: "Arabidopsis", TaxonID: 3702},
+		{FileName: "Caenorhabditis_elegans.WBcel235.pep.all.fa.gz",
+			Species:      "Caenorhabditis elegans (Maupas, 1900)",
+			SpeciesShort: "C. elegans", TaxonID: 6239},
+		{FileName: "Homo_sapiens.GRCh38.pep.all.fa.gz",
+			Species: "Homo sapiens L. 1958", SpeciesShort: "Homo sapiens",
+			TaxonID: 9606},
+	} {
+		_, err = AddGenome(db, g)
+		Expect(err).NotTo(HaveOccurred())
+	}
 })
 
 var _ = AfterSuite(func() {
@@ -1,8 +1,19 @@
 package smithwatr_test
 
 import (
+	"bytes"
+	"context"
 	"errors"
+	"io/ioutil"
 	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	. "github.com/dimus/smithwatr"
 
@@ -42,13 +53,162 @@ var _ = Describe("Smithwatr", func() {
 
 	Describe("EnvVars()", func() {
 		It("reads data from environment", func() {
-			env := EnvVars()
+			env, err := EnvVars()
+			Expect(err).NotTo(HaveOccurred())
 			Expect(env.DbHost).To(Equal("pg"))
 			Expect(env.DbUser).To(Equal("postgres"))
 			Expect(env.Db).To(Equal("smithwatr"))
 			Expect(env.GapOpens).To(Equal(10))
 			Expect(env.GapExtends).To(Equal(1))
 		})
+
+		It("uses defaults for missing variables", func() {
+			defer restoreEnv("JOB_LEASE")()
+			os.Unsetenv("JOB_LEASE")
+			env, err := EnvVars()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(env.JobLease).To(Equal(10 * time.Minute))
+		})
+
+		It("reads the misspelled gap open variable", func() {
+			defer restoreEnv("GAP_OPEN_PENALTY")()
+			os.Unsetenv("GAP_OPEN_PENALTY")
+			defer restoreEnv("GAP_OPEN_PENTALTY")()
+			os.Setenv("GAP_OPEN_PENTALTY", "12")
+			env, err := EnvVars()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(env.GapOpens).To(Equal(12))
+		})
+
+		It("reads optional saving settings", func() {
+			defer restoreEnv("SAVE_BATCH_SIZE")()
+			os.Setenv("SAVE_BATCH_SIZE", "50")
+			env, err := EnvVars()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(env.SaveBatchSize).To(Equal(50))
+			Expect(env.SaveInterval).To(BeNumerically(">", 0))
+
+			os.Setenv("SAVE_BATCH_SIZE", "many")
+			_, err = EnvVars()
+			envErr, ok := err.(*EnvError)
+			Expect(ok).To(BeTrue())
+			Expect(envErr.Var).To(Equal("SAVE_BATCH_SIZE"))
+		})
+	})
+
+	Describe("LoadConfig()", func() {
+		var path string
+		// environment overrides config files, so variables of tested keys
+		// are removed
+		vars := []string{"TOP_N", "MIN_SCORE", "MAX_EVALUE", "RBH_TIES"}
+		var restore []func()
+
+		BeforeEach(func() {
+			restore = nil
+			for _, v := range vars {
+				restore = append(restore, restoreEnv(v))
+				os.Unsetenv(v)
+			}
+			dir, err := ioutil.TempDir("", "smithwatr")
+			Expect(err).NotTo(HaveOccurred())
+			path = filepath.Join(dir, "smithwatr.yaml")
+			data := []byte("top_n: 3\nmin_score: 20\nmax_evalue: 0.01\n")
+			Expect(ioutil.WriteFile(path, data, 0644)).To(Succeed())
+		})
+
+		AfterEach(func() {
+			os.RemoveAll(filepath.Dir(path))
+			for _, r := range restore {
+				r()
+			}
+		})
+
+		It("layers config file, environment and flags", func() {
+			os.Setenv("MIN_SCORE", "30")
+			env, settings, args, err := LoadConfig([]string{"-config", path,
+				"-max-evalue", "0.5", "runs"})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(args).To(Equal([]string{"runs"}))
+			Expect(env.TopN).To(Equal(3))
+			Expect(env.MinScore).To(Equal(30))
+			Expect(env.MaxEvalue).To(Equal(0.5))
+			sources := make(map[string]string)
+			for _, s := range settings {
+				sources[s.Key] = s.Source
+			}
+			Expect(sources["top_n"]).To(Equal(SourceFile))
+			Expect(sources["min_score"]).To(Equal(SourceEnv))
+			Expect(sources["max_evalue"]).To(Equal(SourceFlag))
+			Expect(sources["rbh_ties"]).To(Equal(SourceDefault))
+		})
+
+		It("reads TOML files", func() {
+			toml := filepath.Join(filepath.Dir(path), "smithwatr.toml")
+			data := []byte("top_n = 4\nrbh_ties = \"none\"\n")
+			Expect(ioutil.WriteFile(toml, data, 0644)).To(Succeed())
+			env, _, _, err := LoadConfig([]string{"-config", toml})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(env.TopN).To(Equal(4))
+			Expect(env.RBH.Ties).To(Equal(TiesNone))
+		})
+
+		It("returns ConfigError for invalid values", func() {
+			_, _, _, err := LoadConfig([]string{"-cpu-capacity", "2"})
+			configErr, ok := err.(*ConfigError)
+			Expect(ok).To(BeTrue())
+			Expect(configErr.Key).To(Equal("cpu_capacity"))
+			Expect(configErr.Source).To(Equal(SourceFlag))
+		})
+
+		It("rejects unknown keys in config files", func() {
+			data := []byte("top_m: 3\n")
+			Expect(ioutil.WriteFile(path, data, 0644)).To(Succeed())
+			_, _, _, err := LoadConfig([]string{"-config", path})
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("unknown keys top_m"))
+		})
+
+		It("reads sizes with units", func() {
+			env, _, _, err := LoadConfig([]string{"-memory-budget", "1.5GB"})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(env.MemoryBudget).To(Equal(int64(3 << 29)))
+		})
+	})
+
+	Describe("ConnString()", func() {
+		It("builds a connection URL from settings", func() {
+			c := Env{DbHost: "pg", DbUser: "postgres", Db: "smithwatr",
+				DbPort: 5433, DbPassword: "p@ss", DbSSLMode: "verify-full",
+				DbSSLRootCert: "/certs/ca.pem", DbAppName: "smithwatr"}
+			res, err := ConnString(c)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(res).To(Equal("postgres://postgres:p%40ss@pg:5433/smithwatr?" +
+				"application_name=smithwatr&sslmode=verify-full&" +
+				"sslrootcert=%2Fcerts%2Fca.pem"))
+		})
+
+		It("finds the password in a password file", func() {
+			f, err := ioutil.TempFile("", "pgpass")
+			Expect(err).NotTo(HaveOccurred())
+			defer os.Remove(f.Name())
+			_, err = f.WriteString("# comment\nother:*:*:*:wrong\n" +
+				"pg:5432:*:postgres:se\\:cret\n")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(f.Close()).To(Succeed())
+			c := Env{DbHost: "pg", DbUser: "postgres", Db: "smithwatr",
+				DbPort: 5432, DbPassFile: f.Name(), DbSSLMode: "disable"}
+			res, err := ConnString(c)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(res).To(Equal("postgres://postgres:se%3Acret@pg:5432/" +
+				"smithwatr?sslmode=disable"))
+		})
+
+		It("uses DSN as it is", func() {
+			dsn := "host=pg user=postgres dbname=smithwatr"
+			res, err := ConnString(Env{DbDSN: dsn, DbHost: "other"})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(res).To(Equal(dsn))
+		})
 	})
 
 	Describe("SmithWaterman()", func() {
@@ -80,26 +240,907 @@ var _ = Describe("Smithwatr", func() {
 		})
 	})
 
+	Describe("Matcher", func() {
+		It("gives the same alignments as SmithWaterman", func() {
+			seqs := []string{"MADRGFCSADGSDPLWDWNVTWNTSNPDFTKCF",
+				"MANRGFCSADGWPLWDWDVTWNTSNPDFTKCF", "WDWDVTW", "MANRGF", "AA"}
+			var genes []Gene
+			for i, s := range seqs {
+				genes = append(genes, Gene{ID: i + 1, Seq: []rune(s),
+					SeqLen: len(s)})
+			}
+			var m Matcher
+			for _, g1 := range genes {
+				for _, g2 := range genes {
+					res := m.Align(g1, g2, b62, conf)
+					Expect(res).To(Equal(SmithWaterman(g1, g2, b62, conf)))
+				}
+			}
+		})
+	})
+
 	Describe("ImportData()", func() {
 		It("imports data to the database", func() {
-			ImportData(db, conf)
-			Expect(NotEmpty(db, "genes")).To(Equal(true))
+			Expect(ImportData(db, conf)).To(Succeed())
+			Expect(NotEmpty(db, "genes")).To(BeTrue())
+		})
+	})
+
+	Describe("Migrations()", func() {
+		It("returns built-in migrations in order", func() {
+			ms, err := Migrations()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(ms[0].Name).To(Equal("genomes"))
+			for i, m := range ms {
+				Expect(m.Up).NotTo(BeEmpty())
+				Expect(m.Down).NotTo(BeEmpty())
+				if i > 0 {
+					Expect(m.Version).To(BeNumerically(">", ms[i-1].Version))
+				}
+			}
+		})
+
+		It("finds the database schema up to date", func() {
+			Expect(CheckSchema(db)).To(Succeed())
+		})
+	})
+
+	Describe("ParseHeader()", func() {
+		It("reads Ensembl headers", func() {
+			h, err := ParseHeader(">ENSP00000451042.1 pep " +
+				"chromosome:GRCh38:14:22449113:22449125:1 " +
+				"gene:ENSG00000211923.1 transcript:ENST00000390458.1 " +
+				"gene_biotype:TR_D_gene transcript_biotype:TR_D_gene " +
+				"gene_symbol:TRDD3 description:T cell receptor delta diversity 3")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(h).To(Equal(Header{ID: "ENSP00000451042.1",
+				Accession: "ENSP00000451042.1", Symbol: "TRDD3",
+				Biotype: "TR_D_gene", Locus: "ENSG00000211923.1",
+				Desc: "T cell receptor delta diversity 3"}))
+		})
+
+		It("reads UniProt headers", func() {
+			h, err := ParseHeader(">sp|P69905-2|HBA_HUMAN Hemoglobin subunit " +
+				"alpha OS=Homo sapiens OX=9606 GN=HBA1 PE=1 SV=2")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(h).To(Equal(Header{ID: "sp|P69905-2|HBA_HUMAN",
+				Accession: "P69905-2", Symbol: "HBA1", Organism: "Homo sapiens",
+				TaxonID: 9606, Biotype: "protein_coding", Locus: "P69905",
+				Desc: "Hemoglobin subunit alpha"}))
+		})
+
+		It("reads NCBI RefSeq headers", func() {
+			h, err := ParseHeader(">gi|4504349|ref|NP_000509.1| " +
+				"hemoglobin subunit beta [Homo sapiens]")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(h.Accession).To(Equal("NP_000509.1"))
+			Expect(h.Organism).To(Equal("Homo sapiens"))
+			Expect(h.Desc).To(Equal("hemoglobin subunit beta"))
+		})
+
+		It("reads Araport headers", func() {
+			h, err := ParseHeader(">AT1G01020.2 | Symbols: ARV1, ATARV1 | " +
+				"ARV1 family protein | Chr1:6788-8737 REVERSE LENGTH=194")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(h).To(Equal(Header{ID: "AT1G01020.2",
+				Accession: "AT1G01020.2", Symbol: "ARV1",
+				Organism: "Arabidopsis thaliana", Biotype: "protein_coding",
+				Locus: "AT1G01020", Desc: "ARV1 family protein"}))
+		})
+
+		It("accepts headers without description", func() {
+			Expect(ParseHeader(">P1")).
+				To(Equal(Header{ID: "P1", Accession: "P1", Locus: "P1"}))
+			_, err := ParseHeader(">")
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Describe("FastaParser", func() {
+		parse := func(fp FastaParser, data string) ([]Gene, error) {
+			var genes []Gene
+			err := fp.Parse(strings.NewReader(data), func(g Gene) error {
+				genes = append(genes, g)
+				return nil
+			})
+			return genes, err
+		}
+
+		It("reads every record including the last one", func() {
+			data := ">A1 first\r\nmkv\r\n\r\nLL*\r\n\n>B2 second\nAC\nDE"
+			genes, err := parse(FastaParser{Path: "test.fa", Strict: true}, data)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(genes).To(HaveLen(2))
+			Expect(string(genes[0].Seq)).To(Equal("MKVLL"))
+			Expect(genes[0].Desc).To(Equal("first"))
+			Expect(string(genes[1].Seq)).To(Equal("ACDE"))
+		})
+
+		It("reads very long lines", func() {
+			seq := strings.Repeat("ACDEFGHIKL", 20000)
+			genes, err := parse(FastaParser{Strict: true}, ">A1\n"+seq+"\n")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(genes[0].SeqLen).To(Equal(len(seq)))
+		})
+
+		It("rejects invalid records in strict mode", func() {
+			_, err := parse(FastaParser{Path: "test.fa", Strict: true},
+				">A1\nMK\n>B2\nAC1D\n")
+			Expect(err).To(MatchError("Cannot parse test.fa, line 3: sequence " +
+				"has 1 invalid characters"))
+		})
+
+		It("fixes invalid records with warnings in lenient mode", func() {
+			var warnings []*ParseError
+			fp := FastaParser{Path: "test.fa",
+				Warn: func(w *ParseError) { warnings = append(warnings, w) }}
+			genes, err := parse(fp, "MK\n>A1\nAC1D\n>B2\n>C3\nA*C\n")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(genes).To(HaveLen(2))
+			Expect(string(genes[0].Seq)).To(Equal("ACXD"))
+			Expect(string(genes[1].Seq)).To(Equal("A*C"))
+			Expect(warnings).To(HaveLen(4))
+			Expect(warnings[0].Line).To(Equal(1))
+			Expect(warnings[2].Line).To(Equal(4))
+		})
+	})
+
+	Describe("RecordParser", func() {
+		parse := func(rp RecordParser, data string) []Gene {
+			var genes []Gene
+			err := rp.Parse(strings.NewReader(data), func(g Gene) error {
+				genes = append(genes, g)
+				return nil
+			})
+			Expect(err).NotTo(HaveOccurred())
+			return genes
+		}
+		hba := Gene{Gene: "sp|P69905|HBA_HUMAN", Accession: "P69905",
+			Locus: "P69905", Desc: "Hemoglobin subunit alpha", Symbol: "HBA1",
+			Organism: "Homo sapiens", TaxonID: 9606, Biotype: "protein_coding",
+			Keywords: []string{"3D-structure", "Heme"}, GO: []string{
+				"GO:0005833", "GO:0020037"},
+			Seq: []rune("MVLSPADKTNVKAAWGKV"), SeqLen: 18}
+
+		It("reads UniProt XML", func() {
+			data := `<?xml version="1.0" encoding="UTF-8"?>
+<uniprot xmlns="http://uniprot.org/uniprot">
+<entry dataset="Swiss-Prot">
+  <accession>P69905</accession>
+  <accession>P01922</accession>
+  <name>HBA_HUMAN</name>
+  <protein><recommendedName>
+    <fullName>Hemoglobin subunit alpha</fullName>
+  </recommendedName></protein>
+  <gene><name type="primary">HBA1</name></gene>
+  <organism>
+    <name type="scientific">Homo sapiens</name>
+    <name type="common">Human</name>
+    <dbReference type="NCBI Taxonomy" id="9606"/>
+  </organism>
+  <dbReference type="GO" id="GO:0005833"/>
+  <dbReference type="GO" id="GO:0020037"/>
+  <dbReference type="Pfam" id="PF00042"/>
+  <keyword id="KW-0002">3D-structure</keyword>
+  <keyword id="KW-0349">Heme</keyword>
+  <sequence length="18">
+MVLSPADKTNVKAAWGKV
+</sequence>
+</entry>
+</uniprot>`
+			Expect(parse(UniprotXMLParser{Strict: true}, data)).
+				To(Equal([]Gene{hba}))
+		})
+
+		It("reads UniProt flat files", func() {
+			data := `ID   HBA_HUMAN               Reviewed;         18 AA.
+AC   P69905; P01922;
+DE   RecName: Full=Hemoglobin subunit alpha;
+DE   AltName: Full=Alpha-globin;
+GN   Name=HBA1; Synonyms=HBA2;
+OS   Homo sapiens (Human).
+OX   NCBI_TaxID=9606;
+DR   GO; GO:0005833; C:hemoglobin complex; IDA:UniProtKB.
+DR   GO; GO:0020037; F:heme binding; IEA:InterPro.
+KW   3D-structure; Heme.
+SQ   SEQUENCE   18 AA;  1800 MW;  15E13666573BBBAE CRC64;
+     MVLSPADKTN VKAAWGKV
+//
+`
+			Expect(parse(UniprotDatParser{Strict: true}, data)).
+				To(Equal([]Gene{hba}))
+		})
+
+		It("reads GenPept flat files", func() {
+			data := `LOCUS       NP_000509                 18 aa            linear   PRI 18-OCT-2017
+DEFINITION  hemoglobin subunit beta [Homo
+            sapiens].
+ACCESSION   NP_000509
+VERSION     NP_000509.1
+KEYWORDS    RefSeq; MANE Select.
+SOURCE      Homo sapiens (human)
+  ORGANISM  Homo sapiens
+            Eukaryota; Metazoa; Chordata.
+FEATURES             Location/Qualifiers
+     source          1..18
+                     /organism="Homo sapiens"
+                     /db_xref="taxon:9606"
+     CDS             1..18
+                     /gene="HBB"
+                     /db_xref="GO:0005833"
+ORIGIN      
+        1 mvhltpeekn avttlwgk
+//
+`
+			Expect(parse(GenbankParser{Strict: true}, data)).To(Equal([]Gene{{
+				Gene: "NP_000509.1", Accession: "NP_000509.1",
+				Locus: "NP_000509.1", Desc: "hemoglobin subunit beta",
+				Symbol: "HBB", Organism: "Homo sapiens", TaxonID: 9606,
+				Biotype: "protein_coding", Keywords: []string{"RefSeq",
+					"MANE Select"}, GO: []string{"GO:0005833"},
+				Seq: []rune("MVHLTPEEKNAVTTLWGK"), SeqLen: 18}}))
+		})
+
+		It("reports flat file lines without required values", func() {
+			save := func(Gene) error { return nil }
+			err := UniprotDatParser{Path: "test.dat", Strict: true}.Parse(
+				strings.NewReader("ID\nAC   P1;\n     MK\n//\n"), save)
+			Expect(err).To(MatchError("Cannot parse test.dat, line 1: " +
+				"ID line has no entry name"))
+			err = UniprotDatParser{Path: "test.dat", Strict: true}.Parse(
+				strings.NewReader("ID   A_B\nAC   ;\n     MK\n//\n"), save)
+			Expect(err).To(MatchError("Cannot parse test.dat, line 2: " +
+				"AC line has no accession"))
+
+			var warnings []*ParseError
+			gp := GenbankParser{Path: "test.gp",
+				Warn: func(w *ParseError) { warnings = append(warnings, w) }}
+			data := "LOCUS       NP_1\nVERSION\nORIGIN\n        1 mk\n//\n" +
+				"LOCUS       NP_2\nVERSION     NP_2.1\nORIGIN\n        1 ac\n//\n"
+			Expect(parse(gp, data)).To(HaveLen(1))
+			Expect(warnings).To(HaveLen(2))
+			Expect(warnings[0].Line).To(Equal(2))
+		})
+	})
+
+	Describe("Genome registry", func() {
+		It("adds, imports and removes a genome", func() {
+			dir, err := ioutil.TempDir("", "smithwatr")
+			Expect(err).NotTo(HaveOccurred())
+			defer os.RemoveAll(dir)
+			path := filepath.Join(dir, "test.fa")
+			data := []byte(">P1 first\nMKVLL\n>P2 second\nACDE\n")
+			Expect(ioutil.WriteFile(path, data, 0644)).To(Succeed())
+
+			g, err := AddGenome(db, Genome{FileName: path,
+				Species: "Testus testus", SpeciesShort: "Test", TaxonID: 1})
+			Expect(err).NotTo(HaveOccurred())
+			qpath := filepath.Join(dir, "query.fa")
+			Expect(ioutil.WriteFile(qpath, []byte(">Q1\nMKVLL\n"), 0644)).
+				To(Succeed())
+			q, err := AddGenome(db, Genome{FileName: qpath,
+				Species: "Testus quaerens", SpeciesShort: "Query", TaxonID: 2})
+			Expect(err).NotTo(HaveOccurred())
+			defer RemoveGenome(db, q.ID)
+			Expect(ImportData(db, conf)).To(Succeed())
+			g, err = GetGenomeInfo(db, g.ID)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(g.GenesNum).To(Equal(2))
+			Expect(ListGenomes(db)).To(ContainElement(g))
+
+			// the query gene does not change, but its hits in the genome do
+			run, err := FindOrCreateRun(db, q.ID, g.ID, conf)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(ImportJobs(db, run)).To(Succeed())
+			err = Align(context.Background(), db, run, -1, b62, conf)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(countMatches(run)).To(Equal(2))
+			Expect(RunFinished(db, run)).To(BeTrue())
+
+			rep, err := ImportGenome(db, conf, g)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(rep.Skipped).To(BeTrue())
+
+			data = []byte(">P1 first\nMKVLA\n>P3 third\nWWW\n")
+			Expect(ioutil.WriteFile(path, data, 0644)).To(Succeed())
+			rep, err = ImportGenome(db, conf, g)
+			Expect(err).NotTo(HaveOccurred())
+			Expect([]int{rep.Added, rep.Removed, rep.Changed, rep.Unchanged}).
+				To(Equal([]int{1, 1, 1, 0}))
+			Expect(ImportHistory(db, g.ID)).To(HaveLen(2))
+			g, err = GetGenomeInfo(db, g.ID)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(countMatches(run)).To(Equal(0))
+			Expect(RunFinished(db, run)).To(BeFalse())
+
+			err = Align(context.Background(), db, run, -1, b62, conf)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(countMatches(run)).To(Equal(2))
+
+			Expect(RemoveGenome(db, g.ID)).To(Succeed())
+			Expect(ListGenomes(db)).NotTo(ContainElement(g))
+		})
+
+		It("aligns top hits again when a best target is removed", func() {
+			dir, err := ioutil.TempDir("", "smithwatr")
+			Expect(err).NotTo(HaveOccurred())
+			defer os.RemoveAll(dir)
+			path := filepath.Join(dir, "test.fa")
+			data := []byte(">P1\nMKVLL\n>P2\nMKVAA\n>P3\nWWW\n")
+			Expect(ioutil.WriteFile(path, data, 0644)).To(Succeed())
+			g, err := AddGenome(db, Genome{FileName: path,
+				Species: "Testus testus", SpeciesShort: "Test", TaxonID: 1})
+			Expect(err).NotTo(HaveOccurred())
+			defer RemoveGenome(db, g.ID)
+			qpath := filepath.Join(dir, "query.fa")
+			Expect(ioutil.WriteFile(qpath, []byte(">Q1\nMKVLL\n"), 0644)).
+				To(Succeed())
+			q, err := AddGenome(db, Genome{FileName: qpath,
+				Species: "Testus quaerens", SpeciesShort: "Query", TaxonID: 2})
+			Expect(err).NotTo(HaveOccurred())
+			defer RemoveGenome(db, q.ID)
+			Expect(ImportData(db, conf)).To(Succeed())
+
+			c := conf
+			c.TopN = 1
+			run, err := FindOrCreateRun(db, q.ID, g.ID, c)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(ImportJobs(db, run)).To(Succeed())
+			Expect(Align(context.Background(), db, run, -1, b62, c)).
+				To(Succeed())
+			Expect(countMatches(run)).To(Equal(1))
+
+			data = []byte(">P2\nMKVAA\n>P3\nWWW\n")
+			Expect(ioutil.WriteFile(path, data, 0644)).To(Succeed())
+			rep, err := ImportGenome(db, conf, g)
+			Expect(err).NotTo(HaveOccurred())
+			Expect([]int{rep.Added, rep.Removed, rep.Changed}).
+				To(Equal([]int{0, 1, 0}))
+			Expect(countMatches(run)).To(Equal(0))
+			Expect(RunFinished(db, run)).To(BeFalse())
+			Expect(Align(context.Background(), db, run, -1, b62, c)).
+				To(Succeed())
+			Expect(countMatches(run)).To(Equal(1))
+		})
+
+		It("skips genomes with missing files on import", func() {
+			g, err := AddGenome(db, Genome{FileName: "/nonexistent/test.fa",
+				Species: "Testus testus", SpeciesShort: "Test", TaxonID: 1})
+			Expect(err).NotTo(HaveOccurred())
+			defer RemoveGenome(db, g.ID)
+			Expect(ImportData(db, conf)).To(Succeed())
+			Expect(ImportHistory(db, g.ID)).To(BeEmpty())
+		})
+
+		It("rejects EMBL and GenBank nucleotide files", func() {
+			dir, err := ioutil.TempDir("", "smithwatr")
+			Expect(err).NotTo(HaveOccurred())
+			defer os.RemoveAll(dir)
+			path := filepath.Join(dir, "test.embl")
+			data := []byte("ID   X56734; SV 1; linear; mRNA; STD; PLN; 8 BP.\n" +
+				"AC   X56734;\nSQ   Sequence 8 BP;\n     aaacaaac 8\n//\n")
+			Expect(ioutil.WriteFile(path, data, 0644)).To(Succeed())
+
+			g, err := AddGenome(db, Genome{FileName: path,
+				Species: "Testus testus", SpeciesShort: "Test", TaxonID: 1})
+			Expect(err).NotTo(HaveOccurred())
+			defer RemoveGenome(db, g.ID)
+			_, err = ImportGenome(db, conf, g)
+			Expect(err).To(MatchError(ContainSubstring(
+				"EMBL nucleotide files are not supported")))
+
+			data = []byte("LOCUS       X56734      8 bp    mRNA    linear   " +
+				"PLN 12-SEP-1993\nVERSION     X56734.1\nORIGIN\n" +
+				"        1 aaacaaac\n//\n")
+			Expect(ioutil.WriteFile(path, data, 0644)).To(Succeed())
+			_, err = ImportGenome(db, conf, g)
+			Expect(err).To(MatchError(ContainSubstring(
+				"GenBank nucleotide files are not supported")))
+		})
+	})
+
+	Describe("FindOrCreateRun()", func() {
+		It("reuses a run with the same genomes and parameters", func() {
+			run1, err := FindOrCreateRun(db, 1, 2, conf)
+			Expect(err).NotTo(HaveOccurred())
+			run2, err := FindOrCreateRun(db, 1, 2, conf)
+			Expect(err).NotTo(HaveOccurred())
+			run3, err := FindOrCreateRun(db, 1, 3, conf)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(run1.ID).To(Equal(run2.ID))
+			Expect(run1.ID).NotTo(Equal(run3.ID))
+			Expect(GetRun(db, run3.ID)).To(Equal(run3))
+		})
+	})
+
+	Describe("PlanRuns()", func() {
+		// runs with unusual gap penalties are not touched by other specs,
+		// jobs left from earlier suites are removed
+		planConf := func(gapOpen int) Env {
+			c := conf
+			c.GapOpens = gapOpen
+			_, err := db.Exec(`DELETE FROM jobs WHERE run_id IN
+			                     (SELECT id FROM runs WHERE gap_open = $1)`,
+				gapOpen)
+			Expect(err).NotTo(HaveOccurred())
+			return c
+		}
+
+		It("plans all ordered genome pairs", func() {
+			c := planConf(97)
+			ids, err := GenomeIDs(db)
+			Expect(err).NotTo(HaveOccurred())
+			runs, err := PlanRuns(db, c, true)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(runs).To(HaveLen(len(ids) * len(ids)))
+			for _, r := range runs {
+				Expect(RunFinished(db, r)).To(BeFalse())
+			}
+		})
+
+		It("skips finished runs", func() {
+			c := planConf(96)
+			ids, err := GenomeIDs(db)
+			Expect(err).NotTo(HaveOccurred())
+			done, err := FindOrCreateRun(db, ids[0], ids[0], c)
+			Expect(err).NotTo(HaveOccurred())
+			_, err = db.Exec(`INSERT INTO jobs (run_id, gene_id, status)
+			                    (SELECT $1, id, 'finished' FROM genes
+			                       WHERE genome_id = $2 LIMIT 1)`,
+				done.ID, ids[0])
+			Expect(err).NotTo(HaveOccurred())
+			runs, err := PlanRuns(db, c, true)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(runs).To(HaveLen(len(ids)*len(ids) - 1))
+			for _, r := range runs {
+				Expect(r.ID).NotTo(Equal(done.ID))
+			}
+		})
+
+		It("plans unordered genome pairs once", func() {
+			c := planConf(98)
+			ids, err := GenomeIDs(db)
+			Expect(err).NotTo(HaveOccurred())
+			runs, err := PlanRuns(db, c, false)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(runs).To(HaveLen(len(ids) * (len(ids) + 1) / 2))
+			for _, r := range runs {
+				Expect(r.QueryGenomeID).To(BeNumerically("<=", r.TargetGenomeID))
+			}
 		})
 	})
 
 	Describe("ImportJobs()", func() {
 		It("imports jobs to the database", func() {
-			ImportData(db, conf)
-			ImportJobs(db, 1)
-			Expect(NotEmpty(db, "jobs")).To(Equal(true))
+			Expect(ImportData(db, conf)).To(Succeed())
+			run, err := FindOrCreateRun(db, 1, 2, conf)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(ImportJobs(db, run)).To(Succeed())
+			Expect(NotEmpty(db, "jobs")).To(BeTrue())
+			var wrong int
+			err = db.QueryRow(`SELECT count(*)
+			                     FROM jobs j JOIN genes g ON g.id = j.gene_id
+			                     WHERE j.run_id = $1
+			                       AND j.seq_len <> length(g.sequence)`,
+				run.ID).Scan(&wrong)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(wrong).To(BeZero())
+		})
+
+		It("queues jobs for several runs", func() {
+			Expect(ImportData(db, conf)).To(Succeed())
+			run1, err := FindOrCreateRun(db, 1, 2, conf)
+			Expect(err).NotTo(HaveOccurred())
+			run2, err := FindOrCreateRun(db, 1, 3, conf)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(ImportJobs(db, run1)).To(Succeed())
+			Expect(ImportJobs(db, run2)).To(Succeed())
+			rps, err := ListRuns(db)
+			Expect(err).NotTo(HaveOccurred())
+			var p1, p2 RunProgress
+			for _, rp := range rps {
+				switch rp.ID {
+				case run1.ID:
+					p1 = rp
+				case run2.ID:
+					p2 = rp
+				}
+			}
+			Expect(p1.Pending).To(BeNumerically(">", 0))
+			Expect(p1.Pending + p1.Started + p1.Finished).
+				To(Equal(p2.Pending + p2.Started + p2.Finished))
+		})
+
+		It("queues one job per locus for longest isoform runs", func() {
+			Expect(ImportData(db, conf)).To(Succeed())
+			c := conf
+			c.LongestIsoform = true
+			run, err := FindOrCreateRun(db, 1, 2, c)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(ImportJobs(db, run)).To(Succeed())
+			var jobs, loci int
+			err = db.QueryRow("SELECT count(*) FROM jobs WHERE run_id = $1",
+				run.ID).Scan(&jobs)
+			Expect(err).NotTo(HaveOccurred())
+			err = db.QueryRow(`SELECT count(DISTINCT locus) FROM genes
+			                     WHERE genome_id = 1`).Scan(&loci)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(jobs).To(Equal(loci))
+		})
+	})
+
+	Describe("ReclaimJobs()", func() {
+		It("returns stale started jobs to pending", func() {
+			Expect(ImportData(db, conf)).To(Succeed())
+			run, err := FindOrCreateRun(db, 1, 2, conf)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(ImportJobs(db, run)).To(Succeed())
+			_, err = db.Exec(`UPDATE jobs
+			                     SET status = 'started',
+			                         heartbeat_at = now() - interval '1 hour'`)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(ReclaimJobs(db, time.Minute)).To(BeNumerically(">", 0))
+			Expect(ReclaimJobs(db, time.Minute)).To(Equal(0))
 		})
 	})
 
 	Describe("Align()", func() {
 		It("Aligns genes and saves data", func() {
-			ImportData(db, conf)
-			ImportJobs(db, 1)
-			Align(db, 2, -1, b62, conf)
+			Expect(ImportData(db, conf)).To(Succeed())
+			run, err := FindOrCreateRun(db, 1, 2, conf)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(ImportJobs(db, run)).To(Succeed())
+			err = Align(context.Background(), db, run, -1, b62, conf)
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("saves every alignment before returning", func() {
+			run := smallRun(conf, 3, 1, 11)
+			targets := 7
+			err := Align(context.Background(), db, run, targets, b62, conf)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(countMatches(run)).To(Equal(11 * targets))
+			Expect(RunFinished(db, run)).To(BeTrue())
+		})
+
+		It("keeps only top hits that pass thresholds", func() {
+			c := conf
+			c.TopN = 3
+			run := smallRun(c, 3, 1, 11)
+			err := Align(context.Background(), db, run, 7, b62, conf)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(countMatches(run)).To(Equal(11 * 3))
+
+			c.TopN = 0
+			c.MinScore = 1000000
+			run = smallRun(c, 3, 1, 11)
+			err = Align(context.Background(), db, run, 7, b62, conf)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(countMatches(run)).To(Equal(0))
+			Expect(RunFinished(db, run)).To(BeTrue())
+		})
+
+		It("returns unfinished jobs to pending when cancelled", func() {
+			Expect(ImportData(db, conf)).To(Succeed())
+			run, err := FindOrCreateRun(db, 1, 3, conf)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(ImportJobs(db, run)).To(Succeed())
+			ctx, cancel := context.WithTimeout(context.Background(),
+				2*time.Second)
+			defer cancel()
+			Expect(Align(ctx, db, run, -1, b62, conf)).To(Succeed())
+			rps, err := ListRuns(db)
+			Expect(err).NotTo(HaveOccurred())
+			for _, rp := range rps {
+				if rp.ID == run.ID {
+					Expect(rp.Started).To(Equal(0))
+					Expect(rp.Pending).To(BeNumerically(">", 0))
+				}
+			}
+		})
+	})
+
+	Describe("MemoryScheduler", func() {
+		It("estimates memory of a score matrix", func() {
+			Expect(PairMemory(99, 199)).To(Equal(int64(100 * (200*8 + 24))))
+		})
+
+		It("keeps alignments under the budget", func() {
+			size := PairMemory(100, 100)
+			ms := NewMemoryScheduler(2*size+size/2, 4)
+			var peak int64
+			var mu sync.Mutex
+			var wg sync.WaitGroup
+			for i := 0; i < 8; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					ms.Acquire(size)
+					mu.Lock()
+					if used := ms.InUse(); used > peak {
+						peak = used
+					}
+					mu.Unlock()
+					time.Sleep(10 * time.Millisecond)
+					ms.Release(size)
+				}()
+			}
+			wg.Wait()
+			Expect(peak).To(Equal(2 * size))
+			Expect(ms.InUse()).To(Equal(int64(0)))
+		})
+
+		It("keeps score matrices of workers within the budget", func() {
+			var genes []Gene
+			for i, l := range []int{400, 30, 250, 120, 400, 60, 300, 10} {
+				seq := []rune(strings.Repeat("MKVLAGHWTE", 40)[:l])
+				genes = append(genes, Gene{ID: i + 1, Seq: seq, SeqLen: l})
+			}
+			budget := 2 * PairMemory(400, 400)
+			ms := NewMemoryScheduler(budget, 3)
+			pairs := make(chan [2]Gene)
+			var unreserved int64
+			var wg sync.WaitGroup
+			for i := 0; i < 3; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					m := WorkerMatcher(ms)
+					defer m.Release(ms)
+					for p := range pairs {
+						kept, held := m.AlignWithin(ms, p[0], p[1], b62, conf)
+						if kept > held {
+							atomic.AddInt64(&unreserved, kept-held)
+						}
+					}
+				}()
+			}
+			for _, g1 := range genes {
+				for _, g2 := range genes {
+					pairs <- [2]Gene{g1, g2}
+				}
+			}
+			close(pairs)
+			wg.Wait()
+			Expect(unreserved).To(BeZero())
+			Expect(ms.Peak()).To(BeNumerically("<=", budget))
+			Expect(ms.InUse()).To(BeZero())
+		})
+
+		It("runs an alignment larger than the budget alone", func() {
+			ms := NewMemoryScheduler(100, 1)
+			ms.Acquire(PairMemory(50, 50))
+			Expect(ms.InUse()).To(Equal(PairMemory(50, 50)))
+			ms.Release(PairMemory(50, 50))
+		})
+
+	})
+
+	Describe("Work units", func() {
+		ids := func(genes []Gene) []int {
+			var res []int
+			for _, g := range genes {
+				res = append(res, g.ID)
+			}
+			return res
+		}
+
+		It("sorts genes longest first keeping the order of equal ones", func() {
+			genes := []Gene{{ID: 1, SeqLen: 50}, {ID: 2, SeqLen: 5000},
+				{ID: 3, SeqLen: 80}, {ID: 4, SeqLen: 5000}, {ID: 5, SeqLen: 80}}
+			LongestFirst(genes)
+			Expect(ids(genes)).To(Equal([]int{2, 4, 3, 5, 1}))
+		})
+
+		It("splits targets into units of about UnitCells cells", func() {
+			// every pair has 1024*1024 cells, a quarter of a unit
+			Expect(UnitCells).To(Equal(4 * 1024 * 1024))
+			gene := Gene{SeqLen: 1023}
+			var targets []Gene
+			for i := 1; i <= 10; i++ {
+				targets = append(targets, Gene{ID: i, SeqLen: 1023})
+			}
+			units := WorkUnitTargets(gene, targets)
+			Expect(units).To(HaveLen(3))
+			Expect(ids(units[0])).To(Equal([]int{1, 2, 3, 4}))
+			Expect(ids(units[1])).To(Equal([]int{5, 6, 7, 8}))
+			Expect(ids(units[2])).To(Equal([]int{9, 10}))
+		})
+
+		It("gives a pair larger than a unit its own unit", func() {
+			gene := Gene{SeqLen: 1023}
+			targets := []Gene{{ID: 1, SeqLen: 10}, {ID: 2, SeqLen: UnitCells},
+				{ID: 3, SeqLen: 10}, {ID: 4, SeqLen: 10}}
+			units := WorkUnitTargets(gene, targets)
+			Expect(units).To(HaveLen(3))
+			Expect(ids(units[0])).To(Equal([]int{1}))
+			Expect(ids(units[1])).To(Equal([]int{2}))
+			Expect(ids(units[2])).To(Equal([]int{3, 4}))
+		})
+	})
+
+	Describe("Coordinator", func() {
+		It("distributes a run to workers on localhost", func() {
+			run := smallRun(conf, 3, 1, 6)
+			targets := 7
+			ts := httptest.NewServer(NewCoordinator(db, []Run{run}, targets,
+				conf))
+			defer ts.Close()
+			done := make(chan error)
+			for i := 0; i < 2; i++ {
+				go func() {
+					done <- RunWorker(context.Background(), ts.URL, b62, conf)
+				}()
+			}
+			Expect(<-done).To(Succeed())
+			Expect(<-done).To(Succeed())
+			Expect(RunFinished(db, run)).To(BeTrue())
+			Expect(countMatches(run)).To(Equal(6 * targets))
+		})
+
+		It("stops a worker waiting for a coordinator that hangs", func() {
+			hang := make(chan struct{})
+			ts := httptest.NewServer(http.HandlerFunc(
+				func(w http.ResponseWriter, r *http.Request) { <-hang }))
+			defer ts.Close()
+			defer close(hang)
+			ctx, cancel := context.WithTimeout(context.Background(),
+				100*time.Millisecond)
+			defer cancel()
+			start := time.Now()
+			Expect(RunWorker(ctx, ts.URL, b62, conf)).To(Succeed())
+			Expect(time.Since(start)).To(BeNumerically("<", time.Second))
+		})
+	})
+
+	Describe("ReciprocalHits()", func() {
+		ab := []BestHit{
+			{GeneID: 1, MatchGeneID: 10, Score: 50},
+			{GeneID: 2, MatchGeneID: 20, Score: 40},
+			{GeneID: 2, MatchGeneID: 30, Score: 40},
+			{GeneID: 3, MatchGeneID: 10, Score: 30},
+		}
+		ba := []BestHit{
+			{GeneID: 10, MatchGeneID: 1, Score: 52},
+			{GeneID: 20, MatchGeneID: 2, Score: 41},
+			{GeneID: 30, MatchGeneID: 2, Score: 39},
+		}
+
+		It("accepts all tied hits", func() {
+			res := ReciprocalHits(ab, ba, TiesAll)
+			Expect(res).To(HaveLen(3))
+			Expect(res[0]).To(Equal(Ortholog{GeneID: 1, OrthologGeneID: 10,
+				Score: 50, ReverseScore: 52}))
+		})
+
+		It("ignores genes with tied hits", func() {
+			res := ReciprocalHits(ab, ba, TiesNone)
+			Expect(res).To(HaveLen(1))
+			Expect(res[0].GeneID).To(Equal(1))
+		})
+
+		It("takes the first of tied hits", func() {
+			res := ReciprocalHits(ab, ba, TiesFirst)
+			Expect(res).To(HaveLen(2))
+			Expect(res[1].OrthologGeneID).To(Equal(20))
+		})
+	})
+
+	Describe("Graph", func() {
+		var g *Graph
+
+		BeforeEach(func() {
+			g = NewGraph()
+			for _, e := range [][3]int{{1, 2, 50}, {2, 3, 50}, {1, 3, 50},
+				{4, 5, 60}, {5, 6, 60}, {4, 6, 60}, {3, 4, 5}, {7, 7, 100}} {
+				g.AddEdge(e[0], e[1], float64(e[2]))
+			}
+		})
+
+		It("finds families with Markov clustering", func() {
+			Expect(g.MCL(2)).To(Equal([][]int{{1, 2, 3}, {4, 5, 6}, {7}}))
+		})
+
+		It("finds families with single linkage", func() {
+			Expect(g.SingleLinkage()).To(Equal([][]int{{1, 2, 3, 4, 5, 6}, {7}}))
+		})
+
+		It("builds a graph from alignments", func() {
+			s1 := []rune("MADRGFCSADGSDPLWDWNVTWNTSNPDFTKCF")
+			s2 := []rune("MANRGFCSADGWPLWDWDVTWNTSNPDFTKCF")
+			g1 := Gene{ID: 1, Seq: s1, SeqLen: len(s1)}
+			g2 := Gene{ID: 2, Seq: s2, SeqLen: len(s2)}
+			as := []Alignment{SmithWaterman(g1, g2, b62, conf)}
+			g := NewGraph()
+			g.AddAlignments(as, ClusterOptions{Weight: WeightIdentity,
+				MinWeight: 90})
+			Expect(g.Nodes()).To(BeEmpty())
+			g.AddAlignments(as, ClusterOptions{Weight: WeightIdentity,
+				MinWeight: 80})
+			Expect(g.Nodes()).To(Equal([]int{1, 2}))
+		})
+
+		It("writes OrthoMCL groups", func() {
+			var buf bytes.Buffer
+			err := WriteGroups(&buf, g.SingleLinkage(),
+				map[int]string{7: "At|AT1G01010"}, "SW")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(buf.String()).To(Equal("SW1000: 1 2 3 4 5 6\nSW1001: At|AT1G01010\n"))
+		})
+	})
+
+	Describe("InParalogGroups()", func() {
+		It("groups genes closer to each other than to the reference", func() {
+			hit := func(id1 int, id2 int, score int) Alignment {
+				return Alignment{Gene1: Gene{ID: id1}, Gene2: Gene{ID: id2},
+					Score: score}
+			}
+			self := []Alignment{hit(1, 2, 100), hit(2, 3, 90), hit(4, 5, 30),
+				hit(5, 5, 200)}
+			refBest := map[int]int{1: 50, 2: 60, 3: 70, 4: 80, 5: 10}
+			Expect(InParalogGroups(self, refBest)).
+				To(Equal([][]int{{1, 2, 3}}))
+		})
+	})
+
+	Describe("Self comparison", func() {
+		It("aligns one triangle of a genome without self pairs", func() {
+			run := smallRun(conf, 2, 2, 5)
+			err := Align(context.Background(), db, run, 5, b62, conf)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(countMatches(run)).To(Equal(10))
+			Expect(RunFinished(db, run)).To(BeTrue())
+		})
+
+		It("keeps all hits of a self comparison despite TopN", func() {
+			c := conf
+			c.TopN = 1
+			run := smallRun(c, 2, 2, 5)
+			Expect(run.TopN).To(Equal(0))
+			c.TopN = 0
+			Expect(FindRun(db, 2, 2, c)).To(Equal(run))
+			err := Align(context.Background(), db, run, 5, b62, conf)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(countMatches(run)).To(Equal(10))
 		})
 	})
 })
+
+// restoreEnv returns a function that sets an environment variable back to
+// its current value, or removes it if it is not set now.
+func restoreEnv(name string) func() {
+	val, ok := os.LookupEnv(name)
+	return func() {
+		if ok {
+			os.Setenv(name, val)
+		} else {
+			os.Unsetenv(name)
+		}
+	}
+}
+
+// smallRun prepares a run from scratch with jobs only for the first num
+// genes of the query genome.
+func smallRun(c Env, query int, target int, num int) Run {
+	Expect(ImportData(db, c)).To(Succeed())
+	run, err := FindOrCreateRun(db, query, target, c)
+	Expect(err).NotTo(HaveOccurred())
+	_, err = db.Exec("DELETE FROM jobs WHERE run_id = $1", run.ID)
+	Expect(err).NotTo(HaveOccurred())
+	_, err = db.Exec("DELETE FROM genes_matches WHERE run_id = $1", run.ID)
+	Expect(err).NotTo(HaveOccurred())
+	_, err = db.Exec(`INSERT INTO jobs (run_id, gene_id, seq_len)
+	                    (SELECT $1, id, length(sequence) FROM genes
+	                       WHERE genome_id = $2 ORDER BY id LIMIT $3)`,
+		run.ID, query, num)
+	Expect(err).NotTo(HaveOccurred())
+	return run
+}
+
+func countMatches(run Run) int {
+	var res int
+	err := db.QueryRow("SELECT count(*) FROM genes_matches WHERE run_id = $1",
+		run.ID).Scan(&res)
+	Expect(err).NotTo(HaveOccurred())
+	return res
+}
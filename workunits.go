@@ -0,0 +1,135 @@
+package smithwatr
+
+import "sort"
+
+// unitCells is the number of score matrix cells in a work unit. Pairs of
+// short proteins are sent to workers together, so passing them through a
+// channel costs little compared to aligning them. A pair that is larger
+// than unitCells makes a unit of its own.
+const unitCells = 1 << 22
+
+// maxBufferCells is the largest score matrix a Matcher keeps for reuse
+// when there is no memory budget. Larger matrices are allocated for one
+// alignment, so a single huge pair does not hold its memory for the rest
+// of a run.
+const maxBufferCells = 1 << 24
+
+// workUnit is a query gene with some of its targets, aligned by one
+// worker.
+type workUnit struct {
+	gene    Gene
+	targets []Gene
+}
+
+// workUnits splits targets of a gene into units of about unitCells score
+// matrix cells. The order of targets is kept.
+func workUnits(gene Gene, targets []Gene) []workUnit {
+	var res []workUnit
+	var cells int64
+	start := 0
+	for i, t := range targets {
+		pair := int64(gene.SeqLen+1) * int64(t.SeqLen+1)
+		if i > start && cells+pair > unitCells {
+			res = append(res, workUnit{gene: gene, targets: targets[start:i]})
+			start, cells = i, 0
+		}
+		cells += pair
+	}
+	if start < len(targets) {
+		res = append(res, workUnit{gene: gene, targets: targets[start:]})
+	}
+	return res
+}
+
+// longestFirst sorts genes by the length of their sequences, the longest
+// first. Aligning long pairs first keeps one huge pair from stalling the
+// end of a run while other workers have nothing to do.
+func longestFirst(genes []Gene) {
+	sort.SliceStable(genes, func(i, j int) bool {
+		return genes[i].SeqLen > genes[j].SeqLen
+	})
+}
+
+// Matcher aligns pairs of genes one after another, reusing memory of its
+// score matrix. A Matcher is not safe for concurrent use, every worker
+// needs its own.
+type Matcher struct {
+	cells []int
+	rows  ScoreMatrix
+	// maxCells limits the kept buffer, maxBufferCells is used if it is 0.
+	maxCells int
+	// held is the number of bytes of the buffer reserved in a scheduler.
+	held int64
+}
+
+// Align is the same as SmithWaterman, but it does not allocate a new score
+// matrix if a previous one is large enough.
+func (m *Matcher) Align(g1 Gene, g2 Gene, b62 Blosum62,
+	conf Env) Alignment {
+	return smithWaterman(g1, g2, b62, conf, m.matrix(g1.SeqLen, g2.SeqLen))
+}
+
+// alignWithin aligns a pair within the budget of the scheduler. The buffer
+// of the Matcher stays reserved in the budget until release is called. A
+// pair that does not fit into the buffer is admitted only after the buffer
+// is dropped, so a worker never holds more than one score matrix.
+func (m *Matcher) alignWithin(ms *MemoryScheduler, g1 Gene, g2 Gene,
+	b62 Blosum62, conf Env) Alignment {
+	n, l := g1.SeqLen, g2.SeqLen
+	if (n+1)*(l+1) <= cap(m.cells) && n+1 <= cap(m.rows) {
+		return m.Align(g1, g2, b62, conf)
+	}
+	m.release(ms)
+	size := PairMemory(n, l)
+	ms.Acquire(size)
+	res := m.Align(g1, g2, b62, conf)
+	if m.kept() > 0 {
+		m.held = size
+	} else {
+		// the pair was too large to keep its matrix
+		ms.Release(size)
+	}
+	return res
+}
+
+// release drops the buffer of the Matcher, and returns its memory to the
+// budget of the scheduler.
+func (m *Matcher) release(ms *MemoryScheduler) {
+	ms.Release(m.held)
+	m.held = 0
+	m.cells = nil
+	m.rows = nil
+}
+
+// kept returns the number of bytes of the buffer of the Matcher.
+func (m *Matcher) kept() int64 {
+	return int64(cap(m.cells))*matrixCell + int64(cap(m.rows))*sliceHeader
+}
+
+// matrix returns a score matrix for sequences of lengths n and m, with
+// zeroes in the first row and the first column.
+func (m *Matcher) matrix(n int, l int) ScoreMatrix {
+	size := (n + 1) * (l + 1)
+	limit := m.maxCells
+	if limit == 0 {
+		limit = maxBufferCells
+	}
+	if size > limit {
+		return newScoreMatrix(n, l)
+	}
+	if cap(m.cells) < size {
+		m.cells = make([]int, size)
+	}
+	if cap(m.rows) < n+1 {
+		m.rows = make(ScoreMatrix, n+1)
+	}
+	rows := m.rows[:n+1]
+	for i := range rows {
+		rows[i] = m.cells[i*(l+1) : (i+1)*(l+1)]
+		rows[i][0] = 0
+	}
+	for j := range rows[0] {
+		rows[0][j] = 0
+	}
+	return rows
+}